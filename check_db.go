@@ -2,55 +2,80 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
 	"flag"
 	"fmt"
+	"github.com/wudikua/dqueue/db"
 	"io"
 	"os"
+	"time"
 )
 
-var rpos = 0
-
-func readInt32(r *bufio.Reader) (int, error) {
-	bs := make([]byte, 4)
-	n, err := r.Read(bs)
-
-	if err != nil {
-		return n, err
-	}
-	if n < 4 {
-		return n, err
-	}
-	rpos += n
-	return int(binary.BigEndian.Uint32(bs)), nil
-}
-
 func main() {
 	var file string
+	var keyFile string
 
 	flag.StringVar(&file, "f", "db file", "db file")
+	flag.StringVar(&keyFile, "k", "", "key file to decrypt encrypted records")
 	flag.Parse()
 
-	fpr, _ := os.OpenFile(file, os.O_RDWR, 0666)
-	fos := bufio.NewReader(fpr)
-	for {
-		cur := rpos
-		next, err := readInt32(fos)
-		if err != nil {
+	var keys *db.Keyring
+	if keyFile != "" {
+		var err error
+		if keys, err = db.LoadKeyring(keyFile); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		fmt.Println("header length", next)
-		length := next - cur - 4
-		fmt.Println("data length", length)
-		bs := make([]byte, length)
-		n, err := io.ReadFull(fos, bs)
+	}
+
+	fpr, err := os.OpenFile(file, os.O_RDONLY, 0666)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fi, _ := fpr.Stat()
+	size := int(fi.Size())
+	fos := bufio.NewReader(fpr)
+	rpos := 0
+	for rpos < size {
+		// 读记录,校验CRC
+		e, next, err := db.ReadRecord(fos, rpos, size)
 		if err != nil {
-			fmt.Println(err)
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				fmt.Println("torn record at", rpos)
+			} else {
+				fmt.Println("bad record at", rpos, err)
+			}
 			os.Exit(1)
 		}
-		fmt.Println(string(bs))
-		rpos += n
+		fmt.Println("position", rpos, "next", next, "flags", e.Flags)
+		if e.Flags&db.FLAG_TIME != 0 {
+			fmt.Println("time", time.Unix(0, e.Time).Format(time.RFC3339Nano))
+		}
+		if e.Flags&db.FLAG_SEQ != 0 {
+			fmt.Println("seq", e.Seq)
+		}
+		if e.Flags&db.FLAG_HEADERS != 0 {
+			fmt.Println("headers", e.Headers)
+		}
+		if e.Flags&db.FLAG_COMPRESSED != 0 {
+			fmt.Println("compressed")
+		}
+		if e.Flags&db.FLAG_ENCRYPTED != 0 {
+			fmt.Println("encrypted key", e.Key)
+			if keys == nil {
+				fmt.Println("ciphertext length", len(e.Data))
+				rpos = next
+				fmt.Println()
+				continue
+			}
+			if err := keys.Open(e); err != nil {
+				fmt.Println("decrypt record at", rpos, err)
+				os.Exit(1)
+			}
+		}
+		fmt.Println("data length", len(e.Data))
+		fmt.Println(string(e.Data))
+		rpos = next
 		fmt.Println()
 	}
 }
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 压缩算法,写在压缩数据的第一个字节
+const (
+	COMPRESS_NONE = iota
+	// 标准库的DEFLATE
+	COMPRESS_FLATE
+	// 标准库的gzip
+	COMPRESS_GZIP
+)
+
+// 默认小于这个大小的数据不压缩
+const DEFAULT_COMPRESS_MIN = 128
+
+// 压缩数据的头部 codec(1) 原始长度(4)
+const COMPRESS_HEADER_LEN = 5
+
+// DEFLATE的压缩率不超过1032:1,记录的原始长度超过这个比例的话是坏数据
+const MAX_COMPRESS_RATIO = 1032
+
+// 解析none、flate或者gzip
+func ParseCodec(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "none", "":
+		return COMPRESS_NONE, nil
+	case "flate":
+		return COMPRESS_FLATE, nil
+	case "gzip":
+		return COMPRESS_GZIP, nil
+	}
+	return 0, fmt.Errorf("unknown compression codec %q", name)
+}
+
+// 设置写入时的压缩算法,数据小于min的时候不压缩,压缩以后没有变小的数据也不压缩
+func (this *DQueueDB) SetCompression(codec int, min int) {
+	this.codec = codec
+	this.compressMin = min
+}
+
+// 压缩data,返回算法、原始长度加上压缩后的数据
+func compress(codec int, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var header [COMPRESS_HEADER_LEN]byte
+	header[0] = byte(codec)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	buf.Write(header[:])
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case COMPRESS_FLATE:
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	case COMPRESS_GZIP:
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 解压缩,第一个字节是压缩算法,然后是原始长度,解压后的数据必须正好是原始长度
+// 原始长度不超过数据文件的大小上限和压缩率的上限,坏数据不会让读取的时候分配过大的内存
+func decompress(bs []byte) ([]byte, error) {
+	if len(bs) < COMPRESS_HEADER_LEN {
+		return nil, ErrCorrupt
+	}
+	n := int(binary.BigEndian.Uint32(bs[1:]))
+	body := bs[COMPRESS_HEADER_LEN:]
+	if n > MAX_SEGMENT_SIZE || n > len(body)*MAX_COMPRESS_RATIO {
+		return nil, ErrCorrupt
+	}
+	var r io.Reader
+	switch bs[0] {
+	case COMPRESS_FLATE:
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		r = fr
+	case COMPRESS_GZIP:
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		defer gr.Close()
+		r = gr
+	default:
+		return nil, ErrCorrupt
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrCorrupt
+	}
+	// 解压出来的数据比原始长度长,或者结尾的校验不对
+	var extra [1]byte
+	if _, err := io.ReadFull(r, extra[:]); err != io.EOF {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
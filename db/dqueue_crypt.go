@@ -0,0 +1,148 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// 没有配置密钥文件的时候从这个环境变量读取密钥
+const KEY_ENV = "DQUEUE_KEYS"
+
+// 密钥ID的长度上限,加密数据的格式是 idLen(1) id nonce(12) 密文
+const MAX_KEY_ID_LEN = 0xff
+
+var ErrNoKey = errors.New("encryption key not found")
+
+// AES-GCM的密钥,最后加入的密钥用来加密,所有密钥都可以用来解密,轮换密钥的时候保留旧的密钥
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]cipher.AEAD)}
+}
+
+// 加入一个16、24或者32字节的密钥,并且用它加密之后写入的数据
+func (this *Keyring) Add(id string, key []byte) error {
+	if id == "" || len(id) > MAX_KEY_ID_LEN {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	this.keys[id] = aead
+	this.current = id
+	return nil
+}
+
+// 加密用的密钥ID
+func (this *Keyring) Current() string {
+	if this == nil {
+		return ""
+	}
+	return this.current
+}
+
+// 解析密钥,每个密钥是id:hex,用换行或者逗号分隔,最后一个密钥用来加密,#开头的行是注释
+func ParseKeyring(s string) (*Keyring, error) {
+	keys := NewKeyring()
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid key %q, expect id:hex", fields[0])
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %v", fields[0], err)
+		}
+		if err := keys.Add(strings.TrimSpace(fields[0]), key); err != nil {
+			return nil, fmt.Errorf("invalid key %s: %v", fields[0], err)
+		}
+	}
+	if keys.current == "" {
+		return nil, errors.New("no encryption key")
+	}
+	return keys, nil
+}
+
+// 从文件读取密钥,格式和ParseKeyring一样
+func LoadKeyring(file string) (*Keyring, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(bs))
+}
+
+// 设置加密和解密用的密钥,为空时不加密,读到加密的记录返回ErrNoKey
+func (this *DQueueDB) SetKeyring(keys *Keyring) {
+	this.keys = keys
+}
+
+// 附加数据 version(1) flags(1) idLen(1) 密钥ID 可选字段
+// 记录的版本、标记、密钥ID和写入时间、序号、消息头都不加密,但是被修改以后解密失败
+func additionalData(flags byte, key string, fields []byte) []byte {
+	bs := make([]byte, 0, 3+len(key)+len(fields))
+	bs = append(bs, RECORD_VERSION, flags, byte(len(key)))
+	bs = append(bs, key...)
+	return append(bs, fields...)
+}
+
+// 用当前的密钥加密data,flags是记录最终的标记,fields是编码后的可选字段
+func (this *Keyring) seal(flags byte, fields []byte, data []byte) ([]byte, error) {
+	aead := this.keys[this.current]
+	n := 1 + len(this.current)
+	bs := make([]byte, n+aead.NonceSize(), n+aead.NonceSize()+len(data)+aead.Overhead())
+	bs[0] = byte(len(this.current))
+	copy(bs[1:], this.current)
+	nonce := bs[n:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(bs, nonce, data, additionalData(flags, this.current, fields)), nil
+}
+
+// 解密decodeEntry读出的加密记录,压缩过的数据同时解压
+func (this *Keyring) Open(e *Entry) error {
+	if e.Flags&FLAG_ENCRYPTED == 0 {
+		return nil
+	}
+	if this == nil {
+		return ErrNoKey
+	}
+	aead := this.keys[e.Key]
+	if aead == nil {
+		return ErrNoKey
+	}
+	if len(e.Data) < aead.NonceSize() {
+		return ErrCorrupt
+	}
+	nonce := e.Data[:aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, e.Data[aead.NonceSize():], additionalData(e.Flags, e.Key, e.fields))
+	if err != nil {
+		return ErrCorrupt
+	}
+	if e.Flags&FLAG_COMPRESSED != 0 {
+		if data, err = decompress(data); err != nil {
+			return err
+		}
+	}
+	e.Data = data
+	return nil
+}
@@ -3,7 +3,6 @@ package db
 import (
 	"bufio"
 	"encoding/binary"
-	"errors"
 	"github.com/wudikua/dqueue/global"
 	"io"
 	"log"
@@ -11,24 +10,30 @@ import (
 	"path"
 )
 
+// 默认的数据文件大小
 const MAX_FILE_LIMIT = 1024 * 1024
 
-const (
-	ENEW   = "0"
-	EEMPTY = "1"
-	EFULL  = "2"
-	EAGAIN = "3"
-)
+// 数据文件大小的上限,记录头中的位置只有31位
+const MAX_SEGMENT_SIZE = 1024 * 1024 * 1024
 
 type DQueueDB struct {
-	fpw       *os.File
-	fpr       *os.File
-	fis       *bufio.Writer
-	fos       *bufio.Reader
-	w, r      int
+	fpw  *os.File
+	fpr  *os.File
+	fis  *bufio.Writer
+	fos  *bufio.Reader
+	w, r int
+	// 已经写入缓冲区还没有Flush的位置
+	pw int
+	// 数据文件大小,写位置超过这个大小以后不再写入
+	limit     int
 	dbNo      int
 	file      string
 	syncEvent chan bool
+	// 写入时的压缩算法和压缩的最小数据大小
+	codec       int
+	compressMin int
+	// 加密和解密用的密钥
+	keys *Keyring
 }
 
 func NewInstance(file string, dbNo int) *DQueueDB {
@@ -40,7 +45,7 @@ func NewInstance(file string, dbNo int) *DQueueDB {
 		}
 	}
 	// 判断数据文件是否存在
-	if _, err := os.Stat(file); err == nil {
+	if fi, err := os.Stat(file); err == nil {
 		// 存在
 		fpw, err := os.OpenFile(file, os.O_RDWR, 0666)
 		if err != nil {
@@ -55,13 +60,16 @@ func NewInstance(file string, dbNo int) *DQueueDB {
 		fis := bufio.NewWriter(fpw)
 		fos := bufio.NewReader(fpr)
 		instance = &DQueueDB{
-			dbNo: dbNo,
-			fpw:  fpw,
-			fpr:  fpr,
-			fis:  fis,
-			fos:  fos,
-			file: file,
+			dbNo:  dbNo,
+			fpw:   fpw,
+			fpr:   fpr,
+			fis:   fis,
+			fos:   fos,
+			file:  file,
+			limit: MAX_FILE_LIMIT,
 		}
+		// 默认写位置在文件末尾,正在写的文件由索引重新设置
+		instance.SetWritePos(int(fi.Size()))
 	} else {
 		// 不存在 创建数据文件
 		fpw, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0660)
@@ -77,14 +85,15 @@ func NewInstance(file string, dbNo int) *DQueueDB {
 		fis := bufio.NewWriter(fpw)
 		fos := bufio.NewReader(fpr)
 		instance = &DQueueDB{
-			dbNo: dbNo,
-			fpw:  fpw,
-			fpr:  fpr,
-			fis:  fis,
-			fos:  fos,
-			file: file,
-			w:    0,
-			r:    0,
+			dbNo:  dbNo,
+			fpw:   fpw,
+			fpr:   fpr,
+			fis:   fis,
+			fos:   fos,
+			file:  file,
+			limit: MAX_FILE_LIMIT,
+			w:     0,
+			r:     0,
 		}
 	}
 	return instance
@@ -92,11 +101,16 @@ func NewInstance(file string, dbNo int) *DQueueDB {
 
 func (this *DQueueDB) SetWritePos(w int) {
 	this.fpw.Seek(int64(w), 0)
+	// 丢弃没有Flush的数据
+	this.fis.Reset(this.fpw)
 	this.w = w
+	this.pw = w
 }
 
 func (this *DQueueDB) SetReadPos(r int) {
 	this.fpr.Seek(int64(r), 0)
+	// 丢弃已经缓冲的数据
+	this.fos.Reset(this.fpr)
 	this.r = r
 }
 
@@ -108,6 +122,15 @@ func (this *DQueueDB) GetReadPos() int {
 	return this.r
 }
 
+// 设置数据文件大小
+func (this *DQueueDB) SetLimit(limit int) {
+	this.limit = limit
+}
+
+func (this *DQueueDB) GetLimit() int {
+	return this.limit
+}
+
 func (this *DQueueDB) GetWriteStream() *bufio.Writer {
 	return this.fis
 }
@@ -118,6 +141,7 @@ func (this *DQueueDB) writeInt32(i int) (int, error) {
 	n, err := this.fis.Write(bs)
 	this.fis.Flush()
 	this.w += n
+	this.pw = this.w
 	return n, err
 }
 
@@ -134,21 +158,105 @@ func (this *DQueueDB) readInt32() (int, error) {
 
 func (this *DQueueDB) Write(b []byte) error {
 	// this.w是定位在了最后一个写入超过LIMIT的末尾
-	if this.w >= MAX_FILE_LIMIT {
-		return errors.New(EFULL)
+	if this.w >= this.limit {
+		return ErrFull
 	}
-	// 写下一个的位置 当前位置 + 4个字节 + 数据长度
-	next := this.w + 4 + len(b)
-	// 写下一个数据的起始位置
-	this.writeInt32(next)
-	// 顺序写数据
-	n, err := this.fis.Write(b)
-	if err != nil {
+	if err := this.Append(&Entry{Data: b}); err != nil {
+		this.Discard()
 		return err
 	}
 	// 为了消费不延迟，每次写都刷磁盘，也可以改成每10ms刷磁盘等
-	this.fis.Flush()
-	this.w += n
+	return this.Flush()
+}
+
+// 追加一条记录到缓冲区,不检查文件大小,Flush以后才能被读到
+func (this *DQueueDB) Append(e *Entry) error {
+	c, err := this.Encode(e)
+	if err != nil {
+		return err
+	}
+	return this.AppendEncoded(c)
+}
+
+// 压缩、加密和编码以后的一条记录
+type Encoded struct {
+	flags byte
+	body  []byte
+}
+
+// 压缩、加密并编码一条记录,不写缓冲区,消息头超过上限等错误在写入之前返回
+// e.Flags设置为记录最终的标记
+func (this *DQueueDB) Encode(e *Entry) (*Encoded, error) {
+	// 压缩以后变小的数据才写入压缩后的数据
+	ce := *e
+	compressed := false
+	if this.codec != COMPRESS_NONE && len(e.Data) >= this.compressMin {
+		if c, err := compress(this.codec, e.Data); err == nil && len(c) < len(e.Data) {
+			ce.Data = c
+			compressed = true
+		}
+	}
+	encrypted := false
+	if this.keys.Current() != "" {
+		// 先编码可选字段,记录的标记和可选字段作为附加数据参与校验
+		data := ce.Data
+		ce.Data = nil
+		fields, err := ce.encode()
+		if err != nil {
+			return nil, this.wrap("write", this.pw, err)
+		}
+		flags := ce.Flags | FLAG_ENCRYPTED
+		if compressed {
+			flags |= FLAG_COMPRESSED
+		}
+		c, err := this.keys.seal(flags, fields, data)
+		if err != nil {
+			return nil, this.wrap("write", this.pw, err)
+		}
+		ce.Data = c
+		encrypted = true
+	}
+	b, err := ce.encode()
+	if err != nil {
+		return nil, this.wrap("write", this.pw, err)
+	}
+	if RECORD_HEADER_LEN+len(b) >= RECORD_NEW_FORMAT {
+		return nil, this.wrap("write", this.pw, ErrTooLarge)
+	}
+	if compressed {
+		ce.Flags |= FLAG_COMPRESSED
+	}
+	if encrypted {
+		ce.Flags |= FLAG_ENCRYPTED
+	}
+	e.Flags = ce.Flags
+	return &Encoded{flags: ce.Flags, body: b}, nil
+}
+
+// 追加编码好的记录到缓冲区,不检查文件大小,Flush以后才能被读到
+func (this *DQueueDB) AppendEncoded(c *Encoded) error {
+	if this.pw+RECORD_HEADER_LEN+len(c.body) >= RECORD_NEW_FORMAT {
+		return this.wrap("write", this.pw, ErrTooLarge)
+	}
+	// 写记录头,包含下一条数据的起始位置
+	hs := encodeHeader(this.pw, c.flags, c.body)
+	if _, err := this.fis.Write(hs); err != nil {
+		return this.wrap("write", this.pw, err)
+	}
+	// 顺序写数据
+	if _, err := this.fis.Write(c.body); err != nil {
+		return this.wrap("write", this.pw, err)
+	}
+	this.pw += len(hs) + len(c.body)
+	return nil
+}
+
+// 刷新缓冲区,Append的数据一起对读可见
+func (this *DQueueDB) Flush() error {
+	if err := this.fis.Flush(); err != nil {
+		return this.wrap("write", this.w, err)
+	}
+	this.w = this.pw
 	// 触发同步
 	select {
 	case this.syncEvent <- true:
@@ -157,27 +265,77 @@ func (this *DQueueDB) Write(b []byte) error {
 	return nil
 }
 
+// 丢弃没有Flush的数据
+func (this *DQueueDB) Discard() {
+	this.SetWritePos(this.w)
+}
+
+// 包括缓冲区的数据在内是否已经写满
+func (this *DQueueDB) IsFull() bool {
+	return this.pw >= this.limit
+}
+
+// 已经写入缓冲区还没有Flush的字节数
+func (this *DQueueDB) Buffered() int {
+	return this.pw - this.w
+}
+
 func (this *DQueueDB) Read() ([]byte, error) {
+	e, err := this.ReadEntry()
+	if err != nil {
+		return nil, err
+	}
+	return e.Data, nil
+}
+
+// 顺序读一条记录,包含记录的可选字段
+func (this *DQueueDB) ReadEntry() (*Entry, error) {
 	if this.r == this.w {
-		if this.w >= MAX_FILE_LIMIT {
-			return nil, errors.New(ENEW)
-		}
-		return nil, errors.New(EEMPTY)
-	}
-	// 当前位置
-	cur := this.r
-	// 读下一个数的位置
-	next, _ := this.readInt32()
-	// 计算数据的长度
-	length := next - cur - 4
-	bs := make([]byte, length)
+		if this.w >= this.limit {
+			return nil, ErrNew
+		}
+		return nil, ErrEmpty
+	}
 	// 顺序读数据
-	n, err := io.ReadFull(this.fos, bs)
+	e, next, err := ReadRecord(this.fos, this.r, this.w)
+	if err == nil {
+		err = this.keys.Open(e)
+	}
 	if err != nil {
-		return nil, err
+		// 重新定位到这条记录的开始
+		this.SetReadPos(this.r)
+		return nil, this.wrap("read", this.r, err)
 	}
-	this.r += n
-	return bs, nil
+	this.r = next
+	return e, nil
+}
+
+// 随机读取pos位置的一条数据,不影响顺序读的位置,返回数据和下一条数据的位置
+func (this *DQueueDB) ReadAt(pos int) ([]byte, int, error) {
+	e, next, err := this.ReadEntryAt(pos)
+	if err != nil {
+		return nil, next, err
+	}
+	return e.Data, next, nil
+}
+
+// 随机读取pos位置的一条记录,包含记录的写入时间和序号
+func (this *DQueueDB) ReadEntryAt(pos int) (*Entry, int, error) {
+	if pos >= this.w {
+		if this.w >= this.limit {
+			return nil, pos, ErrNew
+		}
+		return nil, pos, ErrEmpty
+	}
+	r := io.NewSectionReader(this.fpr, int64(pos), int64(this.w-pos))
+	e, next, err := ReadRecord(r, pos, this.w)
+	if err == nil {
+		err = this.keys.Open(e)
+	}
+	if err != nil {
+		return nil, pos, this.wrap("read", pos, err)
+	}
+	return e, next, nil
 }
 
 func (this *DQueueDB) ReadAll(output chan interface{}, quit chan bool) error {
@@ -189,17 +347,14 @@ func (this *DQueueDB) ReadAll(output chan interface{}, quit chan bool) error {
 	retry:
 		cur := rpos
 		if cur == this.w {
-			if this.w >= MAX_FILE_LIMIT {
+			if this.w >= this.limit {
 				return nil
 			}
 			// 阻塞等待下一次的PUSH
-			for {
-				select {
-				case <-quit:
-					return nil
-				case <-this.syncEvent:
-					break
-				}
+			select {
+			case <-quit:
+				return nil
+			case <-this.syncEvent:
 			}
 			goto retry
 		}
@@ -211,8 +366,8 @@ func (this *DQueueDB) ReadAll(output chan interface{}, quit chan bool) error {
 		}
 		// 增加读的位置
 		rpos += n
-		// 转换成长度
-		next := int(binary.BigEndian.Uint32(bs))
+		// 转换成长度,去掉新格式的标记,记录头和数据原样同步
+		next := int(binary.BigEndian.Uint32(bs) &^ RECORD_NEW_FORMAT)
 		length := next - cur - 4
 		// 重新申请数据长度 + 1个字节操作数 + 4个字节长度的字节数组
 		bs2 := make([]byte, length+5)
@@ -232,6 +387,23 @@ func (this *DQueueDB) ReadAll(output chan interface{}, quit chan bool) error {
 	}
 }
 
+// 数据刷到磁盘,Write已经刷新了缓冲区,这里只做fsync
+func (this *DQueueDB) Sync() error {
+	return this.wrap("sync", this.w, this.fpw.Sync())
+}
+
+// 刷新缓冲区并关闭文件
+func (this *DQueueDB) Close() error {
+	err := this.fis.Flush()
+	if e := this.fpw.Close(); err == nil {
+		err = e
+	}
+	if e := this.fpr.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
 func (this *DQueueDB) Stats() map[string]interface{} {
 	stats := make(map[string]interface{}, 3)
 	stats["dbNo"] = this.dbNo
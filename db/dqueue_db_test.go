@@ -1,8 +1,13 @@
 package db
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -192,7 +197,7 @@ func Test_ReadUntilEmpty(t *testing.T) {
 	}
 
 	_, err = db.Read()
-	if err.Error() != EEMPTY {
+	if err != ErrEmpty {
 		t.Fail()
 	}
 }
@@ -203,7 +208,8 @@ func Test_WriteEmpty(t *testing.T) {
 	if db == nil {
 		t.Fail()
 	}
-	bs := make([]byte, 1020)
+	// 每条记录加上记录头正好1KB
+	bs := make([]byte, 1024-RECORD_HEADER_LEN)
 	for i := 0; i < len(bs); i++ {
 		bs[i] = 1
 	}
@@ -219,3 +225,213 @@ func Test_WriteEmpty(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_ReadCorrupt(t *testing.T) {
+	os.Remove("dqueue_0.db")
+	db := NewInstance("dqueue_0.db", 0)
+	db.Write([]byte("abc"))
+	// 修改数据
+	fp, _ := os.OpenFile("dqueue_0.db", os.O_RDWR, 0666)
+	fp.WriteAt([]byte("x"), RECORD_HEADER_LEN)
+	fp.Close()
+	if _, err := db.Read(); !errors.Is(err, ErrCorrupt) {
+		t.Fail()
+	}
+	_, _, err := db.ReadAt(0)
+	var e *Error
+	if !errors.As(err, &e) || e.Err != ErrCorrupt || e.DbNo != 0 || e.Pos != 0 {
+		t.Fail()
+	}
+}
+
+func Test_ReadOldFormat(t *testing.T) {
+	os.Remove("dqueue_0.db")
+	db := NewInstance("dqueue_0.db", 0)
+	// 旧格式的记录
+	db.writeInt32(7)
+	db.fis.Write([]byte("abc"))
+	db.fis.Flush()
+	db.SetWritePos(7)
+	db.Write([]byte("def"))
+	for _, v := range []string{"abc", "def"} {
+		bs, err := db.Read()
+		if err != nil || string(bs) != v {
+			t.Fail()
+		}
+	}
+	end, count := db.Scan(0)
+	if end != db.GetWritePos() || count != 2 {
+		t.Fail()
+	}
+}
+
+func Test_EntryFields(t *testing.T) {
+	os.Remove("dqueue_0.db")
+	db := NewInstance("dqueue_0.db", 0)
+	db.Append(&Entry{Data: []byte("abc"), Time: 100, Seq: 7, Headers: map[string]string{"type": "order", "trace": ""}})
+	db.Append(&Entry{Data: []byte("def")})
+	db.Flush()
+	e, next, err := db.ReadEntryAt(0)
+	if err != nil || string(e.Data) != "abc" || e.Time != 100 || e.Seq != 7 || e.Flags != FLAG_TIME|FLAG_SEQ|FLAG_HEADERS {
+		t.Fail()
+	}
+	if len(e.Headers) != 2 || e.Headers["type"] != "order" {
+		t.Fail()
+	}
+	e, _, err = db.ReadEntryAt(next)
+	if err != nil || string(e.Data) != "def" || e.Flags != 0 || e.Headers != nil {
+		t.Fail()
+	}
+	headers := make(map[string]string)
+	for i := 0; i <= MAX_HEADERS; i++ {
+		headers[fmt.Sprint(i)] = ""
+	}
+	if err := db.Append(&Entry{Data: []byte("ghi"), Headers: headers}); !errors.Is(err, ErrTooLarge) {
+		t.Fail()
+	}
+}
+
+// 压缩和没有压缩的数据可以在同一个数据文件里
+func Test_Compression(t *testing.T) {
+	os.Remove("dqueue_0.db")
+	db := NewInstance("dqueue_0.db", 0)
+	big := strings.Repeat("abcdefgh", 100)
+	db.Append(&Entry{Data: []byte(big)})
+	db.SetCompression(COMPRESS_FLATE, 16)
+	db.Append(&Entry{Data: []byte(big), Headers: map[string]string{"type": "order"}})
+	db.Append(&Entry{Data: []byte("short")})
+	db.SetCompression(COMPRESS_GZIP, 16)
+	db.Append(&Entry{Data: []byte(big), Seq: 3})
+	db.Flush()
+	flags := []byte{0, FLAG_HEADERS | FLAG_COMPRESSED, 0, FLAG_SEQ | FLAG_COMPRESSED}
+	pos := 0
+	for i, f := range flags {
+		e, next, err := db.ReadEntryAt(pos)
+		if err != nil || e.Flags != f {
+			t.Fail()
+			return
+		}
+		if i != 2 && string(e.Data) != big || i == 2 && string(e.Data) != "short" {
+			t.Fail()
+		}
+		pos = next
+	}
+	if db.GetWritePos() >= 3*len(big) {
+		t.Fail()
+	}
+	if _, err := ParseCodec("zstd"); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_Encryption(t *testing.T) {
+	os.Remove("dqueue_0.db")
+	keys, err := ParseKeyring("k1:000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fail()
+		return
+	}
+	db := NewInstance("dqueue_0.db", 0)
+	db.Append(&Entry{Data: []byte("plain")})
+	db.SetKeyring(keys)
+	db.SetCompression(COMPRESS_FLATE, 16)
+	big := strings.Repeat("secret", 100)
+	db.Append(&Entry{Data: []byte(big), Headers: map[string]string{"type": "pii"}})
+	// 轮换密钥,旧的记录仍然可以读
+	keys.Add("k2", []byte("0123456789abcdef0123456789abcdef"))
+	db.Append(&Entry{Data: []byte("secret")})
+	db.Flush()
+	bs, _ := ioutil.ReadFile("dqueue_0.db")
+	if strings.Contains(string(bs), "secret") {
+		t.Fail()
+	}
+	e, next, err := db.ReadEntryAt(0)
+	if err != nil || string(e.Data) != "plain" || e.Flags != 0 {
+		t.Fail()
+	}
+	e, next2, err := db.ReadEntryAt(next)
+	if err != nil || string(e.Data) != big || e.Key != "k1" || e.Headers["type"] != "pii" ||
+		e.Flags != FLAG_HEADERS|FLAG_COMPRESSED|FLAG_ENCRYPTED {
+		t.Fail()
+	}
+	e, _, err = db.ReadEntryAt(next2)
+	if err != nil || string(e.Data) != "secret" || e.Key != "k2" {
+		t.Fail()
+	}
+	// 没有密钥的时候不能读加密的记录,恢复时的检查不需要密钥
+	db.SetKeyring(nil)
+	if _, _, err := db.ReadEntryAt(next); !errors.Is(err, ErrNoKey) {
+		t.Fail()
+	}
+	if end, count := db.Scan(0); end != db.GetWritePos() || count != 3 {
+		t.Fail()
+	}
+	other, _ := ParseKeyring("k1:0f0e0d0c0b0a09080706050403020100")
+	db.SetKeyring(other)
+	if _, _, err := db.ReadEntryAt(next); !errors.Is(err, ErrCorrupt) {
+		t.Fail()
+	}
+	if _, err := ParseKeyring("k1:0102"); err == nil {
+		t.Fail()
+	}
+}
+
+// 记录的标记和可选字段参与加密的校验,修改以后即使重新计算了CRC也不能解密
+func Test_EncryptionTamper(t *testing.T) {
+	keys, _ := ParseKeyring("k1:000102030405060708090a0b0c0d0e0f")
+	for _, tamper := range []func(bs []byte){
+		// 去掉FLAG_COMPRESSED
+		func(bs []byte) { bs[5] &^= FLAG_COMPRESSED },
+		// 修改写入时间
+		func(bs []byte) { bs[RECORD_HEADER_LEN] ^= 1 },
+	} {
+		os.Remove("dqueue_0.db")
+		db := NewInstance("dqueue_0.db", 0)
+		db.SetKeyring(keys)
+		db.SetCompression(COMPRESS_FLATE, 16)
+		db.Append(&Entry{Data: []byte(strings.Repeat("secret", 100)), Time: 1})
+		db.Flush()
+		if e, _, err := db.ReadEntryAt(0); err != nil || e.Flags != FLAG_TIME|FLAG_COMPRESSED|FLAG_ENCRYPTED {
+			t.Fail()
+		}
+		bs, _ := ioutil.ReadFile("dqueue_0.db")
+		tamper(bs)
+		crc := crc32.Checksum(bs[:10], castagnoli)
+		crc = crc32.Update(crc, castagnoli, bs[RECORD_HEADER_LEN:])
+		binary.BigEndian.PutUint32(bs[10:], crc)
+		ioutil.WriteFile("dqueue_0.db", bs, 0660)
+
+		db = NewInstance("dqueue_0.db", 0)
+		db.SetKeyring(keys)
+		if end, count := db.Scan(0); end != len(bs) || count != 1 {
+			t.Fail()
+		}
+		if _, _, err := db.ReadEntryAt(0); !errors.Is(err, ErrCorrupt) {
+			t.Fail()
+		}
+	}
+}
+
+// 解压后的长度必须和记录的原始长度一样,原始长度不能超过压缩率的上限
+func Test_DecompressLength(t *testing.T) {
+	data := []byte(strings.Repeat("abcdefgh", 100))
+	for _, codec := range []int{COMPRESS_FLATE, COMPRESS_GZIP} {
+		bs, err := compress(codec, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := decompress(bs); err != nil || string(out) != string(data) {
+			t.Fail()
+		}
+		for _, n := range []int{len(data) - 1, len(data) + 1, (len(bs)-COMPRESS_HEADER_LEN)*MAX_COMPRESS_RATIO + 1, MAX_SEGMENT_SIZE + 1} {
+			bad := append([]byte(nil), bs...)
+			binary.BigEndian.PutUint32(bad[1:], uint32(n))
+			if _, err := decompress(bad); err != ErrCorrupt {
+				t.Fail()
+			}
+		}
+	}
+	if _, err := decompress([]byte{COMPRESS_FLATE, 0, 0}); err != ErrCorrupt {
+		t.Fail()
+	}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 数据文件的错误,可以用errors.Is判断
+var (
+	// 数据文件已经写满并且读完了,需要换到下一个数据文件
+	ErrNew = errors.New("db file is exhausted")
+	// 没有可以读的数据
+	ErrEmpty = errors.New("no data")
+	// 数据文件已经写满
+	ErrFull  = errors.New("db file is full")
+	ErrAgain = errors.New("try again")
+	// 记录校验失败
+	ErrCorrupt = errors.New("corrupt record")
+	// 数据超过了数据文件能保存的大小
+	ErrTooLarge = errors.New("record too large")
+)
+
+// 读写数据文件出错,记录出错的数据文件编号和位置,Err是ErrCorrupt或者底层的I/O错误
+type Error struct {
+	Op   string
+	DbNo int
+	Pos  int
+	Err  error
+}
+
+func (this *Error) Error() string {
+	return fmt.Sprintf("%s db %d at %d: %v", this.Op, this.DbNo, this.Pos, this.Err)
+}
+
+func (this *Error) Unwrap() error {
+	return this.Err
+}
+
+// 包装数据文件的错误,没有数据和文件写满不需要包装
+func (this *DQueueDB) wrap(op string, pos int, err error) error {
+	if err == nil || err == ErrNew || err == ErrEmpty || err == ErrFull {
+		return err
+	}
+	return &Error{Op: op, DbNo: this.dbNo, Pos: pos, Err: err}
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// 记录格式
+// 旧格式: next(4) data
+// 新格式: next(4,最高位为1) version(1) flags(1) length(4) crc(4) body
+// next是下一条记录的位置,crc是CRC32C,覆盖next到length的10个字节和body
+// body是flags标记的可选字段加上data,可选字段按照标记的顺序排列,length是body的长度
+const (
+	RECORD_VERSION    = 1
+	RECORD_HEADER_LEN = 14
+	// next的最高位标记新格式的记录
+	RECORD_NEW_FORMAT = 0x80000000
+)
+
+// 记录的标记
+const (
+	// 同一批写入的数据,后面还有记录,批次的最后一条记录没有这个标记
+	FLAG_MORE = 1 << iota
+	// 有写入时间,time(8)是UnixNano
+	FLAG_TIME
+	// 有序号,seq(8)
+	FLAG_SEQ
+	// 有消息头,count(2) 每个消息头是klen(2) key vlen(2) value
+	FLAG_HEADERS
+	// data是压缩过的,第一个字节是压缩算法,可选字段不压缩
+	FLAG_COMPRESSED
+	// data是加密过的,idLen(1) 密钥ID nonce 密文,先压缩再加密
+	FLAG_ENCRYPTED
+)
+
+// 消息头的个数和每个key、value的长度上限
+const (
+	MAX_HEADERS    = 64
+	MAX_HEADER_LEN = 0xffff
+)
+
+// 一条记录,Time和Seq为0、Headers为空表示没有这个字段,Key是加密记录的密钥ID
+type Entry struct {
+	Data    []byte
+	Flags   byte
+	Time    int64
+	Seq     int64
+	Headers map[string]string
+	Key     string
+	// 加密记录的可选字段,解密时作为附加数据校验
+	fields []byte
+}
+
+// 编码可选字段和data,同时设置可选字段的标记
+func (this *Entry) encode() ([]byte, error) {
+	this.Flags &^= FLAG_TIME | FLAG_SEQ | FLAG_HEADERS | FLAG_COMPRESSED | FLAG_ENCRYPTED
+	size := len(this.Data)
+	if this.Time != 0 {
+		this.Flags |= FLAG_TIME
+		size += 8
+	}
+	if this.Seq != 0 {
+		this.Flags |= FLAG_SEQ
+		size += 8
+	}
+	if len(this.Headers) > 0 {
+		if len(this.Headers) > MAX_HEADERS {
+			return nil, ErrTooLarge
+		}
+		this.Flags |= FLAG_HEADERS
+		size += 2
+		for k, v := range this.Headers {
+			if len(k) > MAX_HEADER_LEN || len(v) > MAX_HEADER_LEN {
+				return nil, ErrTooLarge
+			}
+			size += 4 + len(k) + len(v)
+		}
+	}
+	body := make([]byte, size)
+	n := 0
+	if this.Flags&FLAG_TIME != 0 {
+		binary.BigEndian.PutUint64(body[n:], uint64(this.Time))
+		n += 8
+	}
+	if this.Flags&FLAG_SEQ != 0 {
+		binary.BigEndian.PutUint64(body[n:], uint64(this.Seq))
+		n += 8
+	}
+	if this.Flags&FLAG_HEADERS != 0 {
+		// 按照key排序,相同的消息头编码结果相同
+		keys := make([]string, 0, len(this.Headers))
+		for k := range this.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		binary.BigEndian.PutUint16(body[n:], uint16(len(keys)))
+		n += 2
+		for _, k := range keys {
+			binary.BigEndian.PutUint16(body[n:], uint16(len(k)))
+			n += 2 + copy(body[n+2:], k)
+			v := this.Headers[k]
+			binary.BigEndian.PutUint16(body[n:], uint16(len(v)))
+			n += 2 + copy(body[n+2:], v)
+		}
+	}
+	copy(body[n:], this.Data)
+	return body, nil
+}
+
+// 解析body中的可选字段,加密的记录只解析出密钥ID,由Keyring.Open解密
+func decodeEntry(flags byte, body []byte) (*Entry, error) {
+	e := &Entry{Flags: flags}
+	fields := body
+	if flags&FLAG_TIME != 0 {
+		if len(body) < 8 {
+			return nil, ErrCorrupt
+		}
+		e.Time = int64(binary.BigEndian.Uint64(body))
+		body = body[8:]
+	}
+	if flags&FLAG_SEQ != 0 {
+		if len(body) < 8 {
+			return nil, ErrCorrupt
+		}
+		e.Seq = int64(binary.BigEndian.Uint64(body))
+		body = body[8:]
+	}
+	if flags&FLAG_HEADERS != 0 {
+		if len(body) < 2 {
+			return nil, ErrCorrupt
+		}
+		count := int(binary.BigEndian.Uint16(body))
+		body = body[2:]
+		e.Headers = make(map[string]string, count)
+		for i := 0; i < count; i++ {
+			var kv [2]string
+			for j := range kv {
+				if len(body) < 2 {
+					return nil, ErrCorrupt
+				}
+				l := int(binary.BigEndian.Uint16(body))
+				if len(body) < 2+l {
+					return nil, ErrCorrupt
+				}
+				kv[j] = string(body[2 : 2+l])
+				body = body[2+l:]
+			}
+			e.Headers[kv[0]] = kv[1]
+		}
+	}
+	e.Data = body
+	if flags&FLAG_ENCRYPTED != 0 {
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return nil, ErrCorrupt
+		}
+		e.Key = string(body[1 : 1+int(body[0])])
+		e.Data = body[1+int(body[0]):]
+		e.fields = fields[:len(fields)-len(body)]
+		return e, nil
+	}
+	if flags&FLAG_COMPRESSED != 0 {
+		data, err := decompress(body)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = data
+	}
+	return e, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// 编码记录头
+func encodeHeader(pos int, flags byte, b []byte) []byte {
+	next := pos + RECORD_HEADER_LEN + len(b)
+	hs := make([]byte, RECORD_HEADER_LEN)
+	binary.BigEndian.PutUint32(hs[0:], uint32(next)|RECORD_NEW_FORMAT)
+	hs[4] = RECORD_VERSION
+	hs[5] = flags
+	binary.BigEndian.PutUint32(hs[6:], uint32(len(b)))
+	crc := crc32.Update(crc32.Checksum(hs[:10], castagnoli), castagnoli, b)
+	binary.BigEndian.PutUint32(hs[10:], crc)
+	return hs
+}
+
+// 从r读取pos位置的一条记录,兼容旧格式,limit是记录结束位置的上限
+// 返回记录和下一条记录的位置
+func ReadRecord(r io.Reader, pos int, limit int) (*Entry, int, error) {
+	hs := make([]byte, RECORD_HEADER_LEN)
+	if _, err := io.ReadFull(r, hs[:4]); err != nil {
+		return nil, pos, err
+	}
+	raw := binary.BigEndian.Uint32(hs)
+	if raw&RECORD_NEW_FORMAT == 0 {
+		// 旧格式的记录
+		next := int(raw)
+		if next < pos+4 || next > limit {
+			return nil, pos, ErrCorrupt
+		}
+		bs := make([]byte, next-pos-4)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return nil, pos, err
+		}
+		return &Entry{Data: bs}, next, nil
+	}
+	if _, err := io.ReadFull(r, hs[4:]); err != nil {
+		return nil, pos, err
+	}
+	next := int(raw &^ RECORD_NEW_FORMAT)
+	length := int(binary.BigEndian.Uint32(hs[6:]))
+	if hs[4] != RECORD_VERSION || next != pos+RECORD_HEADER_LEN+length || next > limit {
+		return nil, pos, ErrCorrupt
+	}
+	bs := make([]byte, length)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, pos, err
+	}
+	crc := crc32.Update(crc32.Checksum(hs[:10], castagnoli), castagnoli, bs)
+	if crc != binary.BigEndian.Uint32(hs[10:]) {
+		return nil, pos, ErrCorrupt
+	}
+	e, err := decodeEntry(hs[5], bs)
+	if err != nil {
+		return nil, pos, err
+	}
+	return e, next, nil
+}
+
+// 数据文件的大小
+func (this *DQueueDB) Size() int {
+	fi, err := this.fpr.Stat()
+	if err != nil {
+		return 0
+	}
+	return int(fi.Size())
+}
+
+// 从from开始检查记录,返回最后一个完整批次的结束位置和其中的记录数
+func (this *DQueueDB) Scan(from int) (int, int) {
+	size := this.Size()
+	if from > size {
+		return from, 0
+	}
+	r := io.NewSectionReader(this.fpr, int64(from), int64(size-from))
+	end, count := from, 0
+	pos, pending := from, 0
+	for pos < size {
+		e, next, err := ReadRecord(r, pos, size)
+		if err != nil {
+			break
+		}
+		pos = next
+		pending++
+		if e.Flags&FLAG_MORE == 0 {
+			// 一个批次完整的写入了
+			end = pos
+			count += pending
+			pending = 0
+		}
+	}
+	return end, count
+}
+
+// 截断文件,丢弃end以后不完整的数据
+func (this *DQueueDB) Truncate(end int) error {
+	if err := this.fpw.Truncate(int64(end)); err != nil {
+		return err
+	}
+	this.SetWritePos(end)
+	if this.r > end {
+		this.SetReadPos(end)
+	}
+	return nil
+}
@@ -1,27 +1,155 @@
 package fs
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/wudikua/dqueue/db"
 	"github.com/wudikua/dqueue/global"
 	"github.com/wudikua/dqueue/idx"
+	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 队列的配置
+type Config struct {
+	// 消费完的数据文件的处理方式
+	Retire int
+	// 归档目录
+	ArchiveDir string
+	// 所有读游标都已经读过以后仍然保留在队列目录的数据文件个数,SEEK可以回退到这些数据文件
+	SeekWindow int
+	// 刷磁盘的策略
+	Sync int
+	// 数据文件大小
+	SegmentSize int
+	// 积压数据的上限,0表示不限制
+	MaxBytes   int64
+	MaxRecords int
+	MaxAge     time.Duration
+	// 超过上限时拒绝写入还是丢弃最早的数据文件
+	Retention int
+	// 延迟消息的桶宽度,也是延迟投递的精度
+	DelayBucket time.Duration
+	// 去重窗口的时间和消息ID个数,都是0表示不去重
+	DedupWindow time.Duration
+	DedupCount  int
+	// 写入数据的压缩算法和压缩的最小数据大小,压缩和没有压缩的数据可以在同一个数据文件里
+	Compression int
+	CompressMin int
+	// AES-GCM密钥文件,每行一个id:hex,最后一个密钥用来加密,为空时从环境变量DQUEUE_KEYS读取
+	KeyFile string
+	// 优先级通道的个数、取数据的策略和每个通道的权重,队列目录下的dqueue.lanes优先
+	Lanes       int
+	LanePolicy  int
+	LaneWeights []int
+	// 队列名,死信的元数据里记录原来的队列,为空时使用队列目录
+	Name string
+	// 按照名字打开死信队列,返回队列和用完以后的释放函数,由队列管理器设置
+	OpenQueue func(name string) (*DQueueFs, func(), error)
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Retire:      RETIRE_DELETE,
+		Sync:        SYNC_NO,
+		SegmentSize: db.MAX_FILE_LIMIT,
+		Retention:   RETENTION_REJECT,
+		DelayBucket: DEFAULT_DELAY_BUCKET,
+		CompressMin: db.DEFAULT_COMPRESS_MIN,
+	}
+}
+
 type DQueueFs struct {
 	dbName    string
 	path      string
+	conf      *Config
 	dbs       map[int]*db.DQueueDB
+	dlock     sync.Mutex
 	idx       *idx.DQueueIndex
 	rlock     sync.Mutex
 	wlock     sync.Mutex
 	syncEvent chan bool
+	// 已经投递还没有确认的消息
+	alock      sync.Mutex
+	inflight   map[uint64]*delivery
+	deliveryId uint64
+	ackFp      *os.File
+	ackSize    int
+	// 移动日志
+	moveFp *os.File
+	// 消费组
+	glock  sync.Mutex
+	groups map[string]*group
+	// 等待合并写入的PUSH请求
+	plock   sync.Mutex
+	pending []*pushReq
+	// 每次PUSH以后关闭并重新创建
+	elock     sync.Mutex
+	pushEvent chan bool
+	// 清理数据文件
+	slock       sync.Mutex
+	syncing     map[int]int
+	retireEvent chan bool
+	retired     int
+	// 刷磁盘
+	dirty     int32
+	syncStats syncStats
+	// 积压数据的限制
+	backlog        int64
+	expired        int32
+	rejected       int64
+	dropped        int64
+	retentionEvent chan bool
+	// 延迟消息,正在写的桶和所有没有投递的桶
+	ylock      sync.Mutex
+	delays     map[int64]*db.DQueueDB
+	buckets    map[int64]bool
+	delayFp    *os.File
+	delayEvent chan bool
+	delayed    int64
+	dispatched int64
+	// 已经开始投递的最后一个桶,不能再写入
+	sealed int64
+	// 去重窗口,没有配置的时候为空
+	dedup *dedupIndex
+	// 加密数据的密钥,没有配置的时候为空
+	keys *db.Keyring
+	// 优先级通道,lanes[0]是队列自己
+	llock       sync.Mutex
+	lanes       []*DQueueFs
+	lanePolicy  int
+	laneWeights []int
+	laneCurrent []int
+	// 死信队列和最大投递次数
+	dlqName      string
+	maxAttempts  int
+	deadLettered int64
+	// 关闭队列
+	clock  sync.Mutex
+	closed chan bool
+	loops  sync.WaitGroup
 }
 
 func NewInstance(path string) *DQueueFs {
+	return NewInstanceWithConfig(path, DefaultConfig())
+}
+
+func NewInstanceWithConfig(path string, conf *Config) *DQueueFs {
+	if conf == nil {
+		conf = DefaultConfig()
+	}
+	// 复制一份,不修改调用者的配置
+	c := *conf
+	conf = &c
+	if conf.SegmentSize <= 0 {
+		conf.SegmentSize = db.MAX_FILE_LIMIT
+	}
+	if conf.SegmentSize > db.MAX_SEGMENT_SIZE {
+		conf.SegmentSize = db.MAX_SEGMENT_SIZE
+	}
 	// 创建队列目录
 	if _, err := os.Stat(path); err != nil {
 		if err := os.Mkdir(path, 0777); err != nil {
@@ -32,9 +160,26 @@ func NewInstance(path string) *DQueueFs {
 	instance := &DQueueFs{
 		dbName:    "dqueue",
 		path:      path,
+		conf:      conf,
 		dbs:       make(map[int]*db.DQueueDB, 1),
 		syncEvent: make(chan bool),
+		pushEvent: make(chan bool),
+		syncing:   make(map[int]int),
+		// 缓冲一个事件,清理期间的触发不会丢失
+		retireEvent:    make(chan bool, 1),
+		retentionEvent: make(chan bool, 1),
+		delays:         make(map[int64]*db.DQueueDB),
+		buckets:        make(map[int64]bool),
+		delayEvent:     make(chan bool, 1),
+		closed:         make(chan bool),
+	}
+
+	keys, err := loadKeys(conf.KeyFile)
+	if err != nil {
+		log.Println("load keys", path, err)
+		return nil
 	}
+	instance.keys = keys
 
 	// 载入索引文件
 	idx := idx.NewInstance(path + "/dqueue.idx")
@@ -42,91 +187,417 @@ func NewInstance(path string) *DQueueFs {
 		return nil
 	}
 	instance.idx = idx
-	// 载入数据文件
-	dbBegin := idx.GetReadNo()
-	dbEnd := idx.GetWriteNo()
-	for i := dbBegin; i <= dbEnd; i++ {
-		dbs := db.NewInstance(fmt.Sprintf("%s/dqueue_%d.db", path, i), i)
-		if dbs == nil {
+	// 载入正在读和正在写的数据文件,中间的数据文件读到的时候再打开
+	dbBegin := instance.segment(idx.GetReadNo())
+	dbEnd := instance.segment(idx.GetWriteNo())
+	if dbBegin == nil || dbEnd == nil {
+		return nil
+	}
+	dbBegin.SetReadPos(idx.GetReadIndex())
+	dbEnd.SetWritePos(idx.GetWriteIndex())
+	// 修复崩溃时没有写完整的数据,正常关闭的队列不需要检查
+	if !instance.loadClean() {
+		instance.recover()
+	}
+	// 重建去重索引
+	if conf.DedupWindow > 0 || conf.DedupCount > 0 {
+		if err := instance.loadDedup(); err != nil {
 			return nil
 		}
-		instance.dbs[i] = dbs
 	}
-
-	instance.dbs[dbBegin].SetReadPos(idx.GetReadIndex())
-	instance.dbs[dbEnd].SetWritePos(idx.GetWriteIndex())
+	// 载入没有确认的消息
+	if err := instance.loadAck(); err != nil {
+		return nil
+	}
+	if err := instance.loadDeadLetter(); err != nil {
+		return nil
+	}
+	// 恢复没有完成的移动
+	if err := instance.recoverMove(); err != nil {
+		return nil
+	}
+	// 载入消费组
+	if err := instance.loadGroups(); err != nil {
+		return nil
+	}
+	// 载入延迟消息的桶,恢复没有完成的投递
+	if err := instance.loadDelay(); err != nil {
+		return nil
+	}
+	// 打开优先级通道
+	if err := instance.loadLanes(); err != nil {
+		return nil
+	}
+	// 统计积压数据
+	instance.loadBacklog()
+	if conf.MaxBytes > 0 || conf.MaxRecords > 0 || conf.MaxAge > 0 {
+		instance.loops.Add(1)
+		go instance.retentionLoop()
+	}
+	// 清理已经消费完的数据文件
+	instance.loops.Add(1)
+	go instance.retireLoop()
+	instance.triggerRetire()
+	// 投递到期的延迟消息
+	instance.loops.Add(1)
+	go instance.delayLoop()
+	if conf.Sync == SYNC_EVERYSEC {
+		instance.loops.Add(1)
+		go instance.syncLoop()
+	}
 	return instance
 }
 
+// 一次PUSH请求,同一个请求的数据原子的写入同一个db
+type pushReq struct {
+	bss [][]byte
+	// 这个请求的每条数据都带上的消息头
+	headers map[string]string
+	// 每条数据自己的消息头,投递延迟消息的时候使用
+	each []map[string]string
+	// 消息ID,去重窗口内重复的请求不写入
+	id        string
+	duplicate bool
+	time      int64
+	length    int
+	err       error
+	done      bool
+}
+
 func (this *DQueueFs) Push(bs []byte) (int, error) {
+	return this.PushBatch([][]byte{bs})
+}
+
+// 原子的写入一批数据,返回队列长度,有多个通道的时候是所有通道的总长度
+// 并发的PUSH请求由第一个拿到wlock的请求合并写入,只Flush和fsync一次
+func (this *DQueueFs) PushBatch(bss [][]byte) (int, error) {
+	return this.submit(&pushReq{bss: bss})
+}
+
+// 写入一条带消息头的数据,返回队列长度
+func (this *DQueueFs) PushWithHeaders(bs []byte, headers map[string]string) (int, error) {
+	if err := checkHeaders(headers); err != nil {
+		return 0, err
+	}
+	return this.submit(&pushReq{bss: [][]byte{bs}, headers: headers})
+}
+
+func (this *DQueueFs) submit(req *pushReq) (int, error) {
+	begin := time.Now()
+	this.plock.Lock()
+	this.pending = append(this.pending, req)
+	this.plock.Unlock()
+
 	this.wlock.Lock()
-	defer this.wlock.Unlock()
-	dbs := this.dbs[this.idx.GetWriteNo()]
-push:
-	err := dbs.Write(bs)
-	if err != nil {
-		if err.Error() == db.EFULL {
-			// 当前db写满了,创建新的db
+	if !req.done {
+		// 把等待中的请求一起写入
+		this.plock.Lock()
+		batch := this.pending
+		this.pending = nil
+		this.plock.Unlock()
+		this.commit(batch)
+	}
+	this.wlock.Unlock()
+	this.syncStats.addPush(time.Since(begin))
+	return this.totalLen(req.length), req.err
+}
+
+// 写入一条数据,调用者需要持有wlock
+func (this *DQueueFs) push(bs []byte, headers map[string]string) (int, error) {
+	req := &pushReq{bss: [][]byte{bs}, headers: headers}
+	this.commit([]*pushReq{req})
+	return req.length, req.err
+}
+
+// 写入一组请求,调用者需要持有wlock
+func (this *DQueueFs) commit(batch []*pushReq) {
+	if this.isClosed() {
+		// 关闭以后不再打开数据文件,去掉的通道的目录不会被重新创建
+		for _, req := range batch {
+			req.done = true
+			req.err = ErrClosed
+			req.length = this.idx.GetLength()
+		}
+		return
+	}
+	dbs := this.segment(this.idx.GetWriteNo())
+	// 已经写入缓冲区还没有Flush的请求和数据条数
+	buffered := make([]*pushReq, 0, len(batch))
+	count := 0
+	// 已经Flush的请求
+	flushed := make([]*pushReq, 0, len(batch))
+	// 缓冲区中的消息ID,同一组请求中重复的ID也要去重
+	var ids map[string]bool
+	fail := func(reqs []*pushReq, err error) {
+		for _, req := range reqs {
+			req.err = err
+			req.length = this.idx.GetLength()
+		}
+	}
+	// Flush缓冲区,写索引文件
+	flush := func() {
+		if len(buffered) == 0 {
+			return
+		}
+		w := dbs.GetWritePos()
+		err := dbs.Flush()
+		if err != nil {
+			dbs.Discard()
+			fail(buffered, err)
+		} else {
+			this.idx.Begin()
+			this.idx.SetWriteIndex(dbs.GetWritePos())
+			this.idx.AddLength(count)
+			this.idx.AddSeq(count)
+			this.idx.Commit()
+			atomic.AddInt64(&this.backlog, int64(dbs.GetWritePos()-w))
+			flushed = append(flushed, buffered...)
+			for _, req := range buffered {
+				if req.id != "" && this.dedup != nil {
+					this.addDedup(req.id, req.time)
+				}
+			}
+		}
+		buffered = buffered[:0]
+		count = 0
+		ids = nil
+	}
+	for _, req := range batch {
+		req.done = true
+		if this.isClosed() {
+			fail([]*pushReq{req}, ErrClosed)
+			continue
+		}
+		if req.id != "" && this.dedup != nil && (ids[req.id] || this.isDuplicate(req.id, time.Now().UnixNano())) {
+			// 重复的写入直接返回成功
+			req.duplicate = true
+			req.length = this.idx.GetLength() + count
+			atomic.AddInt64(&this.dedup.duplicates, 1)
+			continue
+		}
+		if this.conf.Retention == RETENTION_REJECT && this.overLimit(req, count, dbs.Buffered()) {
+			atomic.AddInt64(&this.rejected, 1)
+			fail([]*pushReq{req}, ErrLimit)
+			continue
+		}
+		if dbs.IsFull() {
+			// 当前db写满了,刷磁盘以后创建新的db
+			flush()
+			if this.conf.Sync != SYNC_NO {
+				dbs.Sync()
+			}
 			dbNo := this.idx.GetWriteNo()
-			dbs = db.NewInstance(fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo+1), dbNo+1)
+			next := this.openDB(fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo+1), dbNo+1)
+			if next == nil {
+				fail([]*pushReq{req}, errors.New("create db file failed"))
+				continue
+			}
+			next.SetLimit(this.conf.SegmentSize)
+			dbs = next
+			dbs.SetWritePos(0)
+			this.idx.Begin()
 			this.idx.SetWriteNo(dbNo + 1)
 			this.idx.SetWriteIndex(0)
+			this.idx.Commit()
+			this.dlock.Lock()
 			this.dbs[dbNo+1] = dbs
-			goto push
+			this.dlock.Unlock()
+		}
+		// 先编码请求的所有数据,消息头超过上限等错误只让这个请求失败
+		var err error
+		now := time.Now().UnixNano()
+		records := make([]*db.Encoded, len(req.bss))
+		for i, bs := range req.bss {
+			// 每条记录带上写入时间和序号,序号在Flush以后写入索引
+			e := &db.Entry{Data: bs, Time: now, Seq: this.idx.GetSeq() + int64(count+i), Headers: req.headers}
+			if req.each != nil {
+				e.Headers = req.each[i]
+			}
+			// 批次中除了最后一条都标记FLAG_MORE,恢复时不完整的批次整个丢弃
+			if i < len(req.bss)-1 {
+				e.Flags = db.FLAG_MORE
+			}
+			if records[i], err = dbs.Encode(e); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			fail([]*pushReq{req}, err)
+			continue
+		}
+		// 同一个请求的数据不检查文件大小,保证写在同一个db
+		for _, c := range records {
+			if err = dbs.AppendEncoded(c); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			// 缓冲区整个丢弃,缓冲区中的请求一起失败
+			dbs.Discard()
+			fail(buffered, err)
+			fail([]*pushReq{req}, err)
+			buffered = buffered[:0]
+			count = 0
+			ids = nil
+			continue
+		}
+		if req.id != "" {
+			if ids == nil {
+				ids = make(map[string]bool)
+			}
+			ids[req.id] = true
+			req.time = now
 		}
-		return this.idx.GetLength(), err
+		count += len(req.bss)
+		req.length = this.idx.GetLength() + count
+		buffered = append(buffered, req)
+	}
+	flush()
+	if len(flushed) == 0 {
+		return
+	}
+	if this.conf.Retention == RETENTION_DROP {
+		this.triggerRetention()
+	}
+	if err := this.syncWrite(); err != nil {
+		fail(flushed, err)
+		return
 	}
-	// 写索引文件
-	writePos := dbs.GetWritePos()
-	this.idx.SetWriteIndex(writePos)
-	this.idx.IncLength()
-	length := this.idx.GetLength()
 	// 触发同步
 	select {
 	case this.syncEvent <- true:
 	default:
 	}
-	return length, nil
+	this.notifyPush()
+}
+
+// 唤醒等待PUSH的消费者
+func (this *DQueueFs) notifyPush() {
+	this.elock.Lock()
+	close(this.pushEvent)
+	this.pushEvent = make(chan bool)
+	this.elock.Unlock()
+}
+
+// 返回一个在下一次PUSH成功以后被关闭的channel,用来实现阻塞的出队
+func (this *DQueueFs) PushEvent() <-chan bool {
+	this.elock.Lock()
+	defer this.elock.Unlock()
+	return this.pushEvent
+}
+
+// 从头部取出一条数据,返回的Record包含数据的位置、序号、写入时间和消息头
+// 有多个优先级通道的时候按照通道的策略选择通道
+func (this *DQueueFs) Pop() (*Record, error) {
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	if len(this.lanes) > 1 {
+		return this.popLanes()
+	}
+	return this.popHead()
 }
 
-func (this *DQueueFs) Pop() (int, []byte, error) {
+// 从这个通道的头部取出一条数据
+func (this *DQueueFs) popHead() (*Record, error) {
 	this.rlock.Lock()
 	defer this.rlock.Unlock()
-	dbs := this.dbs[this.idx.GetReadNo()]
+	dbs, pos, e, err := this.next()
+	if err != nil {
+		return nil, err
+	}
+	r := newRecord(this.idx.GetReadNo(), pos, e)
+	this.commitRead(dbs)
+	return r, nil
+}
+
+// 从读游标取出下一条数据,只移动数据文件的读位置,不写索引文件
+// 返回数据所在的db和数据的起始位置,调用者需要持有rlock
+func (this *DQueueFs) next() (*db.DQueueDB, int, *db.Entry, error) {
+	if this.isClosed() {
+		return nil, 0, nil, ErrClosed
+	}
+	dbs := this.segment(this.idx.GetReadNo())
 pop:
-	bs, err := dbs.Read()
+	pos := dbs.GetReadPos()
+	e, err := dbs.ReadEntry()
 	if err != nil {
-		if err.Error() == db.ENEW {
+		// 数据文件大小修改过的话,写满的数据文件也可能返回ErrEmpty
+		if err == db.ErrNew || err == db.ErrEmpty {
 			// 读完了,判断是否还有下一个db
 			if this.idx.GetReadNo() < this.idx.GetWriteNo() {
 				dbNo := this.idx.GetReadNo()
-				if this.dbs[this.idx.GetReadNo()+1] != nil {
-					dbs = this.dbs[this.idx.GetReadNo()+1]
-				} else {
-					dbs = db.NewInstance(fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo+1), dbNo+1)
-					this.dbs[dbNo+1] = dbs
-				}
+				atomic.AddInt64(&this.backlog, -int64(dbs.GetWritePos()))
+				dbs = this.segment(dbNo + 1)
+				this.idx.Begin()
 				this.idx.SetReadNo(dbNo + 1)
 				this.idx.SetReadIndex(0)
+				this.idx.Commit()
+				this.triggerRetire()
 				goto pop
 			}
 		}
-		return this.idx.GetLength(), bs, err
+		return dbs, pos, nil, err
 	}
-	// 写索引文件
+	return dbs, pos, e, nil
+}
+
+// 提交读游标,写索引文件,返回队列长度
+func (this *DQueueFs) commitRead(dbs *db.DQueueDB) int {
 	readPos := dbs.GetReadPos()
+	this.idx.Begin()
 	this.idx.SetReadIndex(readPos)
 	this.idx.DecLength()
+	this.idx.Commit()
 	length := this.idx.GetLength()
+	switch this.conf.Sync {
+	case SYNC_ALWAYS:
+		this.idx.Sync()
+	case SYNC_EVERYSEC:
+		atomic.StoreInt32(&this.dirty, 1)
+	}
 	// 触发同步
 	select {
 	case this.syncEvent <- true:
 	default:
 	}
-	return length, bs, err
+	return length
+}
+
+// 获取编号为dbNo的数据文件,没有打开的话打开它
+func (this *DQueueFs) segment(dbNo int) *db.DQueueDB {
+	this.dlock.Lock()
+	defer this.dlock.Unlock()
+	if dbs := this.dbs[dbNo]; dbs != nil {
+		return dbs
+	}
+	dbs := this.openDB(fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo), dbNo)
+	if dbs != nil {
+		dbs.SetLimit(this.conf.SegmentSize)
+		this.dbs[dbNo] = dbs
+	}
+	return dbs
 }
 
 func (this *DQueueFs) SyncDB(queue string, output chan interface{}, quit chan bool) *db.DQueueDB {
+	// 从库断开或者队列关闭的时候退出
+	stop := make(chan bool)
+	go func() {
+		select {
+		case <-quit:
+		case <-this.closed:
+		}
+		close(stop)
+	}()
+	quit = stop
+	// 其他通道加上通道编号一起同步
+	this.syncLanes(queue, output, quit)
+	// 先同步去重快照,快照之后的消息ID在同步的数据文件里
+	if this.dedup != nil {
+		this.wlock.Lock()
+		bs := this.encodeDedup()
+		this.wlock.Unlock()
+		output <- append([]byte{global.OP_DEDUP}, bs...)
+	}
 	for {
 		select {
 		case <-quit:
@@ -142,25 +613,26 @@ func (this *DQueueFs) SyncDB(queue string, output chan interface{}, quit chan bo
 				return nil
 			default:
 			}
-			output <- []byte{
-				global.OP_NEW,
-				byte(i >> 24),
-				byte(i >> 16),
-				byte(i >> 8),
-				byte(i),
+			output <- syncMessage(global.OP_NEW, i)
+			// 同步期间这个数据文件不会被清理
+			if !this.acquireSync(i) {
+				continue
 			}
 			// 判断是不是当前在写的文件
 			if i < dbEnd {
 				// 不是的话创建对象，使用readAll
 				dbold := db.NewInstance(fmt.Sprintf("%s/dqueue_%d.db", this.path, i), i)
-				dbold.SetWritePos(db.MAX_FILE_LIMIT)
+				// 已经写完的文件,读到文件末尾就结束
+				dbold.SetLimit(dbold.GetWritePos())
 				dbold.ReadAll(output, quit)
+				dbold.Close()
 			} else {
 				// 每1s同步消费进度
-				go this.SyncIdx(queue, output)
+				go this.SyncIdx(queue, output, quit)
 				// 使用当前对象
-				this.dbs[i].ReadAll(output, quit)
+				this.segment(i).ReadAll(output, quit)
 			}
+			this.releaseSync(i)
 			// 修改dbEnd
 			dbEnd = this.idx.GetWriteNo()
 		}
@@ -168,12 +640,11 @@ func (this *DQueueFs) SyncDB(queue string, output chan interface{}, quit chan bo
 
 }
 
-func (this *DQueueFs) SyncIdx(queue string, output chan interface{}) {
+func (this *DQueueFs) SyncIdx(queue string, output chan interface{}, quit chan bool) {
 	preWriteNo := -1
 	preReadNo := -1
 	preRead := -1
 	preWrite := -1
-	bs := make([]byte, 13)
 	for {
 		// 阻塞等等入队或者出队事件的触发
 		select {
@@ -181,6 +652,8 @@ func (this *DQueueFs) SyncIdx(queue string, output chan interface{}) {
 			// 10秒强制检查同步
 			goto check_send
 		case <-this.syncEvent:
+		case <-quit:
+			return
 		}
 	check_send:
 		length := this.idx.GetLength()
@@ -190,35 +663,19 @@ func (this *DQueueFs) SyncIdx(queue string, output chan interface{}) {
 		writeIndex := this.idx.GetWriteIndex()
 		if preRead != readIndex || preWrite != writeIndex {
 			// 同步消费写入的offset
-			bs[0] = global.OP_IDX_READ_WRITE_LEN
-			binary.BigEndian.PutUint32(bs[1:], uint32(readIndex))
-			binary.BigEndian.PutUint32(bs[5:], uint32(writeIndex))
-			binary.BigEndian.PutUint32(bs[9:], uint32(length))
-			output <- bs
+			output <- syncMessage(global.OP_IDX_READ_WRITE_LEN, readIndex, writeIndex, length)
 			preRead = readIndex
 			preWrite = writeIndex
 		}
 
 		if preWriteNo != writeNo {
 			// 写队列换页
-			output <- []byte{
-				global.OP_CHANGE_WRITENO,
-				byte(writeNo >> 24),
-				byte(writeNo >> 16),
-				byte(writeNo >> 8),
-				byte(writeNo + 1),
-			}
+			output <- syncMessage(global.OP_CHANGE_WRITENO, writeNo)
 			preWriteNo = writeNo
 		}
 		if preReadNo != readNo {
 			// 读队列换页
-			output <- []byte{
-				global.OP_CHANGE_READNO,
-				byte(readNo >> 24),
-				byte(readNo >> 16),
-				byte(readNo >> 8),
-				byte(readNo + 1),
-			}
+			output <- syncMessage(global.OP_CHANGE_READNO, readNo)
 			preReadNo = readNo
 		}
 
@@ -228,8 +685,24 @@ func (this *DQueueFs) SyncIdx(queue string, output chan interface{}) {
 func (this *DQueueFs) Stats() map[string]interface{} {
 	stats := make(map[string]interface{})
 	stats["idx"] = this.idx.Stats()
+	stats["sync"] = this.syncStats.stats(this.conf.Sync)
+	stats["retention"] = this.retentionStats()
+	stats["inflight"] = this.Inflight()
+	stats["groups"] = this.groupStats()
+	stats["delay"] = this.delayStats()
+	stats["lanes"] = this.laneStats()
+	stats["deadLetter"] = this.deadLetterStats()
+	if this.dedup != nil {
+		stats["dedup"] = this.dedupStats()
+	}
+	stats["encryption"] = this.cryptStats()
+	this.slock.Lock()
+	stats["retired"] = this.retired
+	this.slock.Unlock()
+	this.dlock.Lock()
 	for k, v := range this.dbs {
-		stats[string(k)] = v.Stats()
+		stats[fmt.Sprintf("%d", k)] = v.Stats()
 	}
+	this.dlock.Unlock()
 	return stats
 }
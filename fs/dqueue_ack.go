@@ -0,0 +1,376 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 确认日志的操作
+const (
+	ACK_OP_RESERVE = iota + 1
+	ACK_OP_ACK
+	// 最后一次失败的原因,跟在有原因的投递记录后面
+	ACK_OP_REASON
+)
+
+// 确认日志是格式头加上每条记录 op(1) id(8) dbNo(8) pos(8) deadline(8) attempts(4)
+// 失败原因的记录是 op(1) id(8) reasonLen(2) reason
+const ACK_RECORD_LEN = 37
+
+// 失败原因的长度上限
+const MAX_REASON_LEN = 0xffff
+
+// 确认日志超过这个大小就压缩
+const ACK_COMPACT_LIMIT = 1024 * 1024
+
+var ErrUnknownDelivery = errors.New("unknown delivery id")
+
+// 一条已经投递但还没有确认的消息
+type delivery struct {
+	id       uint64
+	dbNo     int
+	pos      int
+	deadline int64
+	attempts int
+	// 最后一次失败的原因
+	reason string
+	// 正在移动到死信队列,不会被重新投递
+	dead bool
+}
+
+// 投递出去的消息,id用来ack或者nack
+type Reservation struct {
+	Id       uint64
+	Data     []byte
+	Attempts int
+}
+
+// 载入确认日志,恢复没有确认的消息
+func (this *DQueueFs) loadAck() error {
+	this.inflight = make(map[uint64]*delivery)
+	file := this.path + "/dqueue.ack"
+	fp, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(fp)
+	size := 0
+	if header, _ := r.Peek(FORMAT_HEADER_LEN); len(header) == FORMAT_HEADER_LEN {
+		if !hasFormatHeader(header) {
+			fp.Close()
+			return fmt.Errorf("unsupported ack log format %s", file)
+		}
+		r.Discard(FORMAT_HEADER_LEN)
+		size = FORMAT_HEADER_LEN
+	}
+	bs := make([]byte, ACK_RECORD_LEN)
+	for {
+		// 最后一条没有写完整的记录直接丢弃
+		if _, err := io.ReadFull(r, bs[:1]); err != nil {
+			break
+		}
+		if bs[0] == ACK_OP_REASON {
+			id, reason, ok := readReason(r)
+			if !ok {
+				break
+			}
+			size += 11 + len(reason)
+			if d, exists := this.inflight[id]; exists {
+				d.reason = reason
+			}
+			continue
+		}
+		if _, err := io.ReadFull(r, bs[1:]); err != nil {
+			break
+		}
+		size += ACK_RECORD_LEN
+		d := decodeDelivery(bs)
+		switch bs[0] {
+		case ACK_OP_RESERVE:
+			this.inflight[d.id] = d
+		case ACK_OP_ACK:
+			delete(this.inflight, d.id)
+		}
+		if d.id > this.deliveryId {
+			this.deliveryId = d.id
+		}
+	}
+	this.ackFp = fp
+	if size == 0 {
+		// 新的确认日志先写格式头
+		return this.compactAck()
+	}
+	fp.Truncate(int64(size))
+	fp.Seek(int64(size), 0)
+	this.ackSize = size
+	return nil
+}
+
+// 读失败原因的记录,op已经读过
+func readReason(r io.Reader) (uint64, string, bool) {
+	bs := make([]byte, 10)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return 0, "", false
+	}
+	reason := make([]byte, binary.BigEndian.Uint16(bs[8:]))
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint64(bs), string(reason), true
+}
+
+// 编码一条记录,有失败原因的投递后面跟着失败原因的记录,重启以后死信仍然带着原因
+func encodeDelivery(op byte, d *delivery) []byte {
+	size := ACK_RECORD_LEN
+	if op == ACK_OP_RESERVE && d.reason != "" {
+		size += 11 + len(d.reason)
+	}
+	bs := make([]byte, size)
+	bs[0] = op
+	binary.BigEndian.PutUint64(bs[1:], d.id)
+	binary.BigEndian.PutUint64(bs[9:], uint64(d.dbNo))
+	binary.BigEndian.PutUint64(bs[17:], uint64(d.pos))
+	binary.BigEndian.PutUint64(bs[25:], uint64(d.deadline))
+	binary.BigEndian.PutUint32(bs[33:], uint32(d.attempts))
+	if size > ACK_RECORD_LEN {
+		bs[ACK_RECORD_LEN] = ACK_OP_REASON
+		binary.BigEndian.PutUint64(bs[ACK_RECORD_LEN+1:], d.id)
+		binary.BigEndian.PutUint16(bs[ACK_RECORD_LEN+9:], uint16(len(d.reason)))
+		copy(bs[ACK_RECORD_LEN+11:], d.reason)
+	}
+	return bs
+}
+
+func decodeDelivery(bs []byte) *delivery {
+	return &delivery{
+		id:       binary.BigEndian.Uint64(bs[1:]),
+		dbNo:     int(binary.BigEndian.Uint64(bs[9:])),
+		pos:      int(binary.BigEndian.Uint64(bs[17:])),
+		deadline: int64(binary.BigEndian.Uint64(bs[25:])),
+		attempts: int(binary.BigEndian.Uint32(bs[33:])),
+	}
+}
+
+// 追加确认日志,调用者需要持有alock
+func (this *DQueueFs) appendAck(op byte, d *delivery) error {
+	n, err := this.ackFp.Write(encodeDelivery(op, d))
+	this.ackSize += n
+	if err != nil {
+		return err
+	}
+	switch this.conf.Sync {
+	case SYNC_ALWAYS:
+		if err := this.ackFp.Sync(); err != nil {
+			return err
+		}
+	case SYNC_EVERYSEC:
+		atomic.StoreInt32(&this.dirty, 1)
+	}
+	if this.ackSize >= ACK_COMPACT_LIMIT {
+		return this.compactAck()
+	}
+	return nil
+}
+
+// 只保留没有确认的消息,重写确认日志
+func (this *DQueueFs) compactAck() error {
+	file := this.path + "/dqueue.ack"
+	fp, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	size, _ := w.Write(formatHeader())
+	for _, d := range this.inflight {
+		n, _ := w.Write(encodeDelivery(ACK_OP_RESERVE, d))
+		size += n
+	}
+	if err := w.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		fp.Close()
+		return err
+	}
+	this.ackFp.Close()
+	this.ackFp = fp
+	this.ackSize = size
+	return nil
+}
+
+// 取出一条消息,timeout内没有ack的话会被重新投递
+// 确认日志只记录0号通道的位置,有多个优先级通道的队列返回ErrLanes
+func (this *DQueueFs) Reserve(timeout time.Duration) (*Reservation, error) {
+	if err := this.checkSingleLane(); err != nil {
+		return nil, err
+	}
+	// 这次调用中写入死信队列失败的消息直接重新投递
+	var failed map[uint64]bool
+	for {
+		r, dead, err := this.reserve(timeout, failed)
+		if dead == nil {
+			return r, err
+		}
+		// 释放alock以后再写入死信队列
+		if err := this.deadLetter(dead); err != nil {
+			this.logDeadLetter(dead.d, err)
+			if failed == nil {
+				failed = make(map[uint64]bool)
+			}
+			failed[dead.d.id] = true
+		}
+	}
+}
+
+// 用完投递次数的消息不投递,返回给Reserve移动到死信队列
+func (this *DQueueFs) reserve(timeout time.Duration, failed map[uint64]bool) (*Reservation, *deadLetterReq, error) {
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	if this.isClosed() {
+		return nil, nil, ErrClosed
+	}
+	now := time.Now().UnixNano()
+	// 优先重新投递超时或者被nack的消息,用完投递次数的消息移动到死信队列
+	for {
+		var expired *delivery
+		for _, d := range this.inflight {
+			if !d.dead && d.deadline <= now && (expired == nil || d.deadline < expired.deadline ||
+				(d.deadline == expired.deadline && d.id < expired.id)) {
+				expired = d
+			}
+		}
+		if expired == nil {
+			break
+		}
+		if this.exhausted(expired) && !failed[expired.id] {
+			reason := expired.reason
+			if reason == "" {
+				reason = DLQ_REASON_ATTEMPTS
+			}
+			dead, err := this.prepareDeadLetter(expired, reason)
+			if err == nil {
+				return nil, dead, nil
+			}
+			this.logDeadLetter(expired, err)
+		}
+		bs, err := this.readDelivery(expired)
+		if err != nil {
+			// 读不出来的消息不能一直挡住后面的消息,确认掉以后继续
+			log.Println("reserve", this.path, "drop delivery", expired.id, "at", expired.dbNo, expired.pos, err)
+			delete(this.inflight, expired.id)
+			if err := this.appendAck(ACK_OP_ACK, expired); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		this.deliveryId++
+		d := &delivery{
+			id:       this.deliveryId,
+			dbNo:     expired.dbNo,
+			pos:      expired.pos,
+			deadline: now + int64(timeout),
+			attempts: expired.attempts + 1,
+			reason:   expired.reason,
+		}
+		// 先记录新的投递再删除旧的投递,中间崩溃最多重复投递一次
+		if err := this.appendAck(ACK_OP_RESERVE, d); err != nil {
+			return nil, nil, err
+		}
+		this.inflight[d.id] = d
+		delete(this.inflight, expired.id)
+		if err := this.appendAck(ACK_OP_ACK, expired); err != nil {
+			return nil, nil, err
+		}
+		return &Reservation{Id: d.id, Data: bs, Attempts: d.attempts}, nil, nil
+	}
+
+	// 从读游标取新的消息
+	this.rlock.Lock()
+	defer this.rlock.Unlock()
+	dbs, pos, e, err := this.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	this.deliveryId++
+	d := &delivery{
+		id:       this.deliveryId,
+		dbNo:     this.idx.GetReadNo(),
+		pos:      pos,
+		deadline: now + int64(timeout),
+		attempts: 1,
+	}
+	// 先写确认日志再移动读游标,中间崩溃最多重复投递一次
+	if err := this.appendAck(ACK_OP_RESERVE, d); err != nil {
+		dbs.SetReadPos(pos)
+		return nil, nil, err
+	}
+	this.inflight[d.id] = d
+	this.commitRead(dbs)
+	return &Reservation{Id: d.id, Data: e.Data, Attempts: d.attempts}, nil, nil
+}
+
+// 读取投递中的消息,数据文件已经不存在的话返回ErrNotFound
+func (this *DQueueFs) readDelivery(d *delivery) ([]byte, error) {
+	dbs := this.segment(d.dbNo)
+	if dbs == nil {
+		return nil, ErrNotFound
+	}
+	bs, _, err := dbs.ReadAt(d.pos)
+	return bs, err
+}
+
+// 确认消息已经处理完成
+func (this *DQueueFs) Ack(id uint64) error {
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	d, exists := this.inflight[id]
+	if !exists || d.dead {
+		return ErrUnknownDelivery
+	}
+	delete(this.inflight, id)
+	err := this.appendAck(ACK_OP_ACK, d)
+	this.triggerRetire()
+	return err
+}
+
+// 消息处理失败,立刻重新投递
+func (this *DQueueFs) Nack(id uint64) error {
+	return this.NackWithReason(id, "")
+}
+
+// 消息处理失败,立刻重新投递,reason是失败的原因,移动到死信队列的时候记录在元数据里
+func (this *DQueueFs) NackWithReason(id uint64, reason string) error {
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	d, exists := this.inflight[id]
+	if !exists || d.dead {
+		return ErrUnknownDelivery
+	}
+	d.deadline = 0
+	if len(reason) > MAX_REASON_LEN {
+		reason = reason[:MAX_REASON_LEN]
+	}
+	if reason != "" {
+		d.reason = reason
+	}
+	return this.appendAck(ACK_OP_RESERVE, d)
+}
+
+// 还没有确认的消息数
+func (this *DQueueFs) Inflight() int {
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	return len(this.inflight)
+}
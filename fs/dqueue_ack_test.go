@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_ReserveAck(t *testing.T) {
+	os.RemoveAll("test_ack")
+	fs := NewInstance("test_ack")
+	if fs == nil {
+		t.Fail()
+	}
+	fs.Push([]byte("abc"))
+	r, err := fs.Reserve(time.Minute)
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+	if fs.Inflight() != 1 {
+		t.Fail()
+	}
+	if err := fs.Ack(r.Id); err != nil {
+		t.Fail()
+	}
+	if err := fs.Ack(r.Id); err == nil {
+		t.Fail()
+	}
+	if _, err := fs.Reserve(time.Minute); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_ReserveNack(t *testing.T) {
+	os.RemoveAll("test_ack")
+	fs := NewInstance("test_ack")
+	fs.Push([]byte("abc"))
+	fs.Push([]byte("def"))
+	r, _ := fs.Reserve(time.Minute)
+	fs.Nack(r.Id)
+	r2, err := fs.Reserve(time.Minute)
+	if err != nil || string(r2.Data) != "abc" || r2.Attempts != 2 {
+		t.Fail()
+	}
+	r3, err := fs.Reserve(time.Minute)
+	if err != nil || string(r3.Data) != "def" {
+		t.Fail()
+	}
+}
+
+func Test_ReserveTimeout(t *testing.T) {
+	os.RemoveAll("test_ack")
+	fs := NewInstance("test_ack")
+	fs.Push([]byte("abc"))
+	fs.Reserve(time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	r, err := fs.Reserve(time.Minute)
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+}
+
+func Test_ReserveRestart(t *testing.T) {
+	os.RemoveAll("test_ack")
+	fs := NewInstance("test_ack")
+	fs.Push([]byte("abc"))
+	r, _ := fs.Reserve(time.Millisecond)
+	fs = NewInstance("test_ack")
+	if fs.Inflight() != 1 {
+		t.Fail()
+	}
+	time.Sleep(time.Millisecond * 5)
+	r2, err := fs.Reserve(time.Minute)
+	if err != nil || string(r2.Data) != "abc" || r2.Id <= r.Id {
+		t.Fail()
+	}
+}
+
+// 读不出来的投递被丢弃,不会挡住后面的消息
+func Test_ReserveUnreadable(t *testing.T) {
+	os.RemoveAll("test_ack")
+	fs := NewInstance("test_ack")
+	fs.Push([]byte("abc"))
+	fs.Push([]byte("def"))
+	r, _ := fs.Reserve(time.Minute)
+	fs.Nack(r.Id)
+	fs.inflight[r.Id].pos = 1 << 20
+	r, err := fs.Reserve(time.Minute)
+	if err != nil || string(r.Data) != "def" {
+		t.Fail()
+	}
+	if fs.Inflight() != 1 {
+		t.Fail()
+	}
+}
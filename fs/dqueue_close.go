@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var ErrClosed = errors.New("queue is closed")
+
+// 队列是否已经关闭
+func (this *DQueueFs) isClosed() bool {
+	select {
+	case <-this.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 关闭队列,等待后台协程退出,数据文件和索引刷到磁盘以后写入正常关闭的标记
+func (this *DQueueFs) Close() error {
+	this.clock.Lock()
+	defer this.clock.Unlock()
+	if this.isClosed() {
+		return nil
+	}
+	close(this.closed)
+	this.loops.Wait()
+	// 等待正在进行的读写
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	this.rlock.Lock()
+	defer this.rlock.Unlock()
+	this.glock.Lock()
+	defer this.glock.Unlock()
+	this.wlock.Lock()
+	defer this.wlock.Unlock()
+
+	var err error
+	keep := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	for i := 1; i < len(this.lanes); i++ {
+		keep(this.lanes[i].Close())
+	}
+	if this.dedup != nil {
+		keep(this.writeDedup(this.encodeDedup()))
+	}
+	this.dlock.Lock()
+	for dbNo, dbs := range this.dbs {
+		keep(dbs.Sync())
+		keep(dbs.Close())
+		delete(this.dbs, dbNo)
+	}
+	this.dlock.Unlock()
+	for _, g := range this.groups {
+		g.lock.Lock()
+		keep(g.idx.Close())
+		g.lock.Unlock()
+	}
+	keep(this.ackFp.Sync())
+	keep(this.ackFp.Close())
+	if this.moveFp != nil {
+		keep(this.moveFp.Close())
+	}
+	this.ylock.Lock()
+	keep(this.closeDelayWriters())
+	if this.delayFp != nil {
+		keep(this.delayFp.Close())
+	}
+	this.ylock.Unlock()
+	keep(this.idx.Close())
+	if err != nil {
+		log.Println("close", this.path, err)
+		return err
+	}
+	return this.writeClean()
+}
+
+// 正常关闭的标记,记录关闭时的写位置
+func (this *DQueueFs) cleanFile() string {
+	return this.path + "/dqueue.clean"
+}
+
+func (this *DQueueFs) writeClean() error {
+	file := this.cleanFile()
+	fp, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fp, "%d %d\n", this.idx.GetWriteNo(), this.idx.GetWriteIndex())
+	if err == nil {
+		err = fp.Sync()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(file + ".tmp")
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// 读取并删除正常关闭的标记,标记和索引、数据文件都一致的时候不需要检查数据文件
+func (this *DQueueFs) loadClean() bool {
+	file := this.cleanFile()
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	// 启动以后的写入不再受标记保护
+	os.Remove(file)
+	var writeNo, writeIndex int
+	if _, err := fmt.Sscanf(string(bs), "%d %d", &writeNo, &writeIndex); err != nil {
+		return false
+	}
+	if writeNo != this.idx.GetWriteNo() || writeIndex != this.idx.GetWriteIndex() {
+		return false
+	}
+	return this.segment(writeNo).Size() == writeIndex
+}
@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_Close(t *testing.T) {
+	os.RemoveAll("test_close1")
+	fs := NewInstance("test_close1")
+	fs.PushBatch([][]byte{[]byte("a"), []byte("b")})
+	if err := fs.Close(); err != nil {
+		t.Fail()
+	}
+	if _, err := os.Stat("test_close1/dqueue.clean"); err != nil {
+		t.Fail()
+	}
+	if _, err := fs.Push([]byte("c")); err != ErrClosed {
+		t.Fail()
+	}
+	if _, err := fs.Pop(); err != ErrClosed {
+		t.Fail()
+	}
+	// 重复关闭
+	if err := fs.Close(); err != nil {
+		t.Fail()
+	}
+
+	fs = NewInstance("test_close1")
+	if _, err := os.Stat("test_close1/dqueue.clean"); err == nil {
+		t.Fail()
+	}
+	if r, err := fs.Pop(); err != nil || string(r.Data) != "a" {
+		t.Fail()
+	}
+	if fs.idx.GetLength() != 1 {
+		t.Fail()
+	}
+}
+
+func Test_CloseThenModified(t *testing.T) {
+	os.RemoveAll("test_close2")
+	fs := NewInstance("test_close2")
+	fs.Push([]byte("a"))
+	fs.Close()
+	// 关闭以后数据文件被修改,标记失效,启动时仍然检查数据文件
+	fp, _ := os.OpenFile("test_close2/dqueue_1.db", os.O_WRONLY|os.O_APPEND, 0666)
+	fp.Write([]byte{1, 2, 3})
+	fp.Close()
+	fs = NewInstance("test_close2")
+	if fi, _ := os.Stat("test_close2/dqueue_1.db"); fi.Size() != int64(fs.idx.GetWriteIndex()) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,34 @@
+package fs
+
+import (
+	"github.com/wudikua/dqueue/db"
+	"os"
+)
+
+// 载入加密数据的密钥,没有配置密钥文件的时候从环境变量读取,都没有的话不加密
+func loadKeys(file string) (*db.Keyring, error) {
+	if file != "" {
+		return db.LoadKeyring(file)
+	}
+	if s := os.Getenv(db.KEY_ENV); s != "" {
+		return db.ParseKeyring(s)
+	}
+	return nil, nil
+}
+
+// 打开队列的数据文件,写入时按照配置压缩和加密,读取时解密
+func (this *DQueueFs) openDB(file string, dbNo int) *db.DQueueDB {
+	dbs := db.NewInstance(file, dbNo)
+	if dbs != nil {
+		dbs.SetCompression(this.conf.Compression, this.conf.CompressMin)
+		dbs.SetKeyring(this.keys)
+	}
+	return dbs
+}
+
+func (this *DQueueFs) cryptStats() map[string]interface{} {
+	stats := make(map[string]interface{}, 2)
+	stats["enabled"] = this.keys != nil
+	stats["key"] = this.keys.Current()
+	return stats
+}
@@ -0,0 +1,255 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 消息ID写在保留的消息头里,只有PushUnique可以写入,崩溃以后从去重快照和快照之后的数据文件重建去重索引
+const DEDUP_HEADER = "x-dqueue-msg-id"
+
+var ErrDedupDisabled = errors.New("dedup is disabled, set a dedup window or count")
+var ErrReservedHeader = errors.New("header " + DEDUP_HEADER + " is reserved")
+
+// 调用者写入的消息头不能包含保留的消息ID
+func checkHeaders(headers map[string]string) error {
+	if _, exists := headers[DEDUP_HEADER]; exists {
+		return ErrReservedHeader
+	}
+	return nil
+}
+
+// 去重快照 header(4) writeNo(8) writeIndex(8) count(4) 每个ID是time(8) idLen(2) id 最后是crc(4)
+const DEDUP_SNAPSHOT_HEADER_LEN = FORMAT_HEADER_LEN + 20
+
+type dedupEntry struct {
+	id   string
+	time int64
+}
+
+// 去重窗口内的消息ID和写入时间,按照写入顺序淘汰
+type dedupIndex struct {
+	ids   map[string]int64
+	order []dedupEntry
+	head  int
+	// 被去重的写入次数
+	duplicates int64
+}
+
+func (this *DQueueFs) dedupFile() string {
+	return this.path + "/dqueue.dedup"
+}
+
+// 写入一条带消息ID的数据,去重窗口内已经写入过这个ID的话不再写入,返回队列长度和是否重复
+// 没有配置去重窗口的时候返回ErrDedupDisabled
+func (this *DQueueFs) PushUnique(bs []byte, id string, headers map[string]string) (int, bool, error) {
+	if this.dedup == nil {
+		return 0, false, ErrDedupDisabled
+	}
+	if id == "" {
+		return 0, false, fmt.Errorf("message id is empty")
+	}
+	if err := checkHeaders(headers); err != nil {
+		return 0, false, err
+	}
+	h := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	h[DEDUP_HEADER] = id
+	req := &pushReq{bss: [][]byte{bs}, headers: h, id: id}
+	length, err := this.submit(req)
+	return length, req.duplicate, err
+}
+
+// 去重窗口内是否已经有这个ID,调用者需要持有wlock
+func (this *DQueueFs) isDuplicate(id string, now int64) bool {
+	t, exists := this.dedup.ids[id]
+	if !exists {
+		return false
+	}
+	return this.conf.DedupWindow <= 0 || t >= now-int64(this.conf.DedupWindow)
+}
+
+// 记录一个消息ID,淘汰窗口以外的ID,调用者需要持有wlock
+func (this *DQueueFs) addDedup(id string, t int64) {
+	d := this.dedup
+	d.ids[id] = t
+	d.order = append(d.order, dedupEntry{id: id, time: t})
+	this.evictDedup(t)
+}
+
+func (this *DQueueFs) evictDedup(now int64) {
+	d := this.dedup
+	for d.head < len(d.order) {
+		e := d.order[d.head]
+		if !(this.conf.DedupCount > 0 && len(d.order)-d.head > this.conf.DedupCount) &&
+			!(this.conf.DedupWindow > 0 && e.time < now-int64(this.conf.DedupWindow)) {
+			break
+		}
+		// 同一个ID后面又写入过的话保留后面的记录
+		if d.ids[e.id] == e.time {
+			delete(d.ids, e.id)
+		}
+		d.head++
+	}
+	// 回收已经淘汰的空间
+	if d.head > 1024 && d.head*2 > len(d.order) {
+		d.order = append([]dedupEntry(nil), d.order[d.head:]...)
+		d.head = 0
+	}
+}
+
+// 编码去重快照,调用者需要持有wlock
+func (this *DQueueFs) encodeDedup() []byte {
+	d := this.dedup
+	size := DEDUP_SNAPSHOT_HEADER_LEN + 4
+	for _, e := range d.order[d.head:] {
+		size += 10 + len(e.id)
+	}
+	bs := make([]byte, size)
+	copy(bs, formatHeader())
+	binary.BigEndian.PutUint64(bs[FORMAT_HEADER_LEN:], uint64(this.idx.GetWriteNo()))
+	binary.BigEndian.PutUint64(bs[FORMAT_HEADER_LEN+8:], uint64(this.idx.GetWriteIndex()))
+	binary.BigEndian.PutUint32(bs[FORMAT_HEADER_LEN+16:], uint32(len(d.order)-d.head))
+	n := DEDUP_SNAPSHOT_HEADER_LEN
+	for _, e := range d.order[d.head:] {
+		binary.BigEndian.PutUint64(bs[n:], uint64(e.time))
+		binary.BigEndian.PutUint16(bs[n+8:], uint16(len(e.id)))
+		n += 10 + copy(bs[n+10:], e.id)
+	}
+	binary.BigEndian.PutUint32(bs[n:], crc32.ChecksumIEEE(bs[:n]))
+	return bs
+}
+
+// 解析去重快照,返回快照时的写位置,快照不完整返回false
+func (this *DQueueFs) decodeDedup(bs []byte) (int, int, bool) {
+	if !hasFormatHeader(bs) || len(bs) < DEDUP_SNAPSHOT_HEADER_LEN+4 {
+		return 0, 0, false
+	}
+	n := len(bs) - 4
+	if binary.BigEndian.Uint32(bs[n:]) != crc32.ChecksumIEEE(bs[:n]) {
+		return 0, 0, false
+	}
+	no := int(binary.BigEndian.Uint64(bs[FORMAT_HEADER_LEN:]))
+	index := int(binary.BigEndian.Uint64(bs[FORMAT_HEADER_LEN+8:]))
+	count := int(binary.BigEndian.Uint32(bs[DEDUP_SNAPSHOT_HEADER_LEN-4:]))
+	pos := DEDUP_SNAPSHOT_HEADER_LEN
+	for i := 0; i < count; i++ {
+		if pos+10 > n {
+			return 0, 0, false
+		}
+		t := int64(binary.BigEndian.Uint64(bs[pos:]))
+		l := int(binary.BigEndian.Uint16(bs[pos+8:]))
+		if pos+10+l > n {
+			return 0, 0, false
+		}
+		this.addDedup(string(bs[pos+10:pos+10+l]), t)
+		pos += 10 + l
+	}
+	return no, index, true
+}
+
+// 写去重快照
+func (this *DQueueFs) writeDedup(bs []byte) error {
+	file := this.dedupFile()
+	fp, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(bs)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(file + ".tmp")
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// 保存去重快照,数据文件被清理之前调用,窗口内的ID不会随着数据文件丢失
+func (this *DQueueFs) saveDedup() error {
+	this.wlock.Lock()
+	bs := this.encodeDedup()
+	this.wlock.Unlock()
+	return this.writeDedup(bs)
+}
+
+// 启动时载入去重快照,再从快照的写位置开始读数据文件里的消息ID
+func (this *DQueueFs) loadDedup() error {
+	this.dedup = &dedupIndex{ids: make(map[string]int64)}
+	dbNo, pos := this.firstNo(), 0
+	if bs, err := ioutil.ReadFile(this.dedupFile()); err == nil {
+		if no, index, ok := this.decodeDedup(bs); ok && no >= dbNo {
+			dbNo, pos = no, index
+		} else if !ok {
+			// 快照损坏的话只能从数据文件重建
+			this.dedup = &dedupIndex{ids: make(map[string]int64)}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for i := dbNo; i <= this.idx.GetWriteNo(); i++ {
+		from := 0
+		if i == dbNo {
+			from = pos
+		}
+		if err := this.scanDedup(i, from); err != nil {
+			return err
+		}
+	}
+	this.evictDedup(time.Now().UnixNano())
+	return nil
+}
+
+// 读一个数据文件里从from开始的消息ID
+func (this *DQueueFs) scanDedup(dbNo int, from int) error {
+	var dbs *db.DQueueDB
+	if dbNo == this.idx.GetWriteNo() {
+		dbs = this.segment(dbNo)
+	} else {
+		file := fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo)
+		if _, err := os.Stat(file); err != nil {
+			return nil
+		}
+		dbs = this.openDB(file, dbNo)
+		if dbs == nil {
+			return fmt.Errorf("open %s failed", file)
+		}
+		dbs.SetLimit(dbs.GetWritePos())
+		defer dbs.Close()
+	}
+	for pos := from; ; {
+		e, next, err := dbs.ReadEntryAt(pos)
+		if err == db.ErrEmpty || err == db.ErrNew {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if id := e.Headers[DEDUP_HEADER]; id != "" {
+			this.addDedup(id, e.Time)
+		}
+		pos = next
+	}
+}
+
+func (this *DQueueFs) dedupStats() map[string]interface{} {
+	this.wlock.Lock()
+	defer this.wlock.Unlock()
+	stats := make(map[string]interface{}, 2)
+	stats["ids"] = len(this.dedup.ids)
+	stats["duplicates"] = atomic.LoadInt64(&this.dedup.duplicates)
+	return stats
+}
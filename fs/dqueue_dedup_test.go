@@ -0,0 +1,140 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_PushUnique(t *testing.T) {
+	os.RemoveAll("test_dedup")
+	conf := DefaultConfig()
+	conf.DedupCount = 2
+	fs := NewInstanceWithConfig("test_dedup", conf)
+	if _, dup, err := fs.PushUnique([]byte("abc"), "1", nil); err != nil || dup {
+		t.Fail()
+	}
+	length, dup, err := fs.PushUnique([]byte("abc"), "1", nil)
+	if err != nil || !dup || length != 1 {
+		t.Fail()
+	}
+	if _, _, err := fs.PushUnique([]byte("abc"), "", nil); err == nil {
+		t.Fail()
+	}
+	// 超过个数的ID被淘汰
+	fs.PushUnique([]byte("def"), "2", nil)
+	fs.PushUnique([]byte("ghi"), "3", nil)
+	if _, dup, _ := fs.PushUnique([]byte("abc"), "1", nil); dup {
+		t.Fail()
+	}
+	r, err := fs.Pop()
+	if err != nil || r.Headers[DEDUP_HEADER] != "1" {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+func Test_DedupWindow(t *testing.T) {
+	os.RemoveAll("test_dedup")
+	conf := DefaultConfig()
+	conf.DedupWindow = 50 * time.Millisecond
+	fs := NewInstanceWithConfig("test_dedup", conf)
+	fs.PushUnique([]byte("abc"), "1", nil)
+	if _, dup, _ := fs.PushUnique([]byte("abc"), "1", nil); !dup {
+		t.Fail()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, dup, _ := fs.PushUnique([]byte("abc"), "1", nil); dup {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 崩溃以后从数据文件重建去重索引
+func Test_DedupRecover(t *testing.T) {
+	os.RemoveAll("test_dedup")
+	conf := DefaultConfig()
+	conf.DedupWindow = time.Hour
+	fs := NewInstanceWithConfig("test_dedup", conf)
+	fs.PushUnique([]byte("abc"), "1", nil)
+
+	fs = NewInstanceWithConfig("test_dedup", conf)
+	if _, dup, _ := fs.PushUnique([]byte("abc"), "1", nil); !dup {
+		t.Fail()
+	}
+	if fs.Len() != 1 {
+		t.Fail()
+	}
+}
+
+// 数据文件被清理以后窗口内的ID保存在去重快照里
+func Test_DedupRetired(t *testing.T) {
+	os.RemoveAll("test_dedup")
+	conf := DefaultConfig()
+	conf.DedupCount = 1000
+	conf.SegmentSize = 100
+	fs := NewInstanceWithConfig("test_dedup", conf)
+	for i := 0; i < 10; i++ {
+		fs.PushUnique([]byte("abcdefghij"), fmt.Sprintf("%d", i), nil)
+	}
+	for {
+		if _, err := fs.Pop(); err != nil {
+			break
+		}
+	}
+	fs.retire()
+	if _, err := os.Stat("test_dedup/dqueue_1.db"); err == nil {
+		t.Fail()
+	}
+	// 清理以后崩溃
+	fs = NewInstanceWithConfig("test_dedup", conf)
+	for i := 0; i < 10; i++ {
+		if _, dup, _ := fs.PushUnique([]byte("abcdefghij"), fmt.Sprintf("%d", i), nil); !dup {
+			t.Fail()
+		}
+	}
+	fs.Close()
+}
+
+// 没有去重窗口的时候不能幂等写入
+func Test_PushUniqueDisabled(t *testing.T) {
+	os.RemoveAll("test_dedup")
+	fs := NewInstance("test_dedup")
+	if _, _, err := fs.PushUnique([]byte("abc"), "1", nil); err != ErrDedupDisabled {
+		t.Fail()
+	}
+	if fs.Len() != 0 {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 调用者不能写入保留的消息头,重启以后不会把它当成消息ID
+func Test_DedupReservedHeader(t *testing.T) {
+	os.RemoveAll("test_dedup")
+	conf := DefaultConfig()
+	conf.DedupWindow = time.Hour
+	fs := NewInstanceWithConfig("test_dedup", conf)
+	headers := map[string]string{DEDUP_HEADER: "1"}
+	if _, err := fs.PushWithHeaders([]byte("abc"), headers); err != ErrReservedHeader {
+		t.Fail()
+	}
+	if _, err := fs.PushDelayedWithHeaders([]byte("abc"), headers, time.Now().Add(time.Hour)); err != ErrReservedHeader {
+		t.Fail()
+	}
+	if _, _, err := fs.PushUnique([]byte("abc"), "2", headers); err != ErrReservedHeader {
+		t.Fail()
+	}
+	fs.PushWithHeaders([]byte("abc"), map[string]string{"x-msg-id": "1"})
+	fs.Close()
+
+	fs = NewInstanceWithConfig("test_dedup", conf)
+	if _, dup, err := fs.PushUnique([]byte("abc"), "1", nil); err != nil || dup {
+		t.Fail()
+	}
+	if fs.Len() != 2 {
+		t.Fail()
+	}
+	fs.Close()
+}
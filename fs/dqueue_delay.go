@@ -0,0 +1,466 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 延迟消息按照投递时间分桶写在delay目录,每个桶是一个数据文件,文件名是桶的开始时间(毫秒)
+// 桶的结束时间到了以后,整个桶按批次移动到队列里,消息不会提前投递,最多延迟一个桶的宽度
+const (
+	DELAY_DIR = "delay"
+	// 默认的桶宽度
+	DEFAULT_DELAY_BUCKET = time.Second
+	// 每次移动到队列的最大条数和字节数,一次移动是一个原子的批次
+	DELAY_BATCH      = 1000
+	DELAY_BATCH_SIZE = 1024 * 1024
+	// 同时打开写的桶的个数
+	MAX_DELAY_WRITERS = 64
+	// 移动失败以后重试的间隔
+	DELAY_RETRY = time.Second
+)
+
+// 投递状态 header(4) bucket(8) offset(8) to(8) writeNo(8) writeIndex(8) length(4) crc(4) crc(4)
+const DELAY_STATE_LEN = FORMAT_HEADER_LEN + 52
+
+// 正在投递的桶,to大于offset表示有一次没有确认完成的移动
+type delayState struct {
+	// 桶的开始时间
+	bucket int64
+	// 已经移动到队列的位置
+	offset int
+	// 正在移动的批次的结束位置
+	to int
+	// 队列移动之前的写位置和第一条数据
+	writeNo    int
+	writeIndex int
+	length     int
+	crc        uint32
+}
+
+func encodeDelayState(s *delayState) []byte {
+	bs := make([]byte, DELAY_STATE_LEN)
+	copy(bs, formatHeader())
+	b := bs[FORMAT_HEADER_LEN:]
+	binary.BigEndian.PutUint64(b[0:], uint64(s.bucket))
+	binary.BigEndian.PutUint64(b[8:], uint64(s.offset))
+	binary.BigEndian.PutUint64(b[16:], uint64(s.to))
+	binary.BigEndian.PutUint64(b[24:], uint64(s.writeNo))
+	binary.BigEndian.PutUint64(b[32:], uint64(s.writeIndex))
+	binary.BigEndian.PutUint32(b[40:], uint32(s.length))
+	binary.BigEndian.PutUint32(b[44:], s.crc)
+	binary.BigEndian.PutUint32(b[48:], crc32.ChecksumIEEE(bs[:DELAY_STATE_LEN-4]))
+	return bs
+}
+
+func decodeDelayState(bs []byte) *delayState {
+	if !hasFormatHeader(bs) || len(bs) < DELAY_STATE_LEN {
+		return nil
+	}
+	if binary.BigEndian.Uint32(bs[DELAY_STATE_LEN-4:]) != crc32.ChecksumIEEE(bs[:DELAY_STATE_LEN-4]) {
+		return nil
+	}
+	b := bs[FORMAT_HEADER_LEN:]
+	return &delayState{
+		bucket:     int64(binary.BigEndian.Uint64(b[0:])),
+		offset:     int(binary.BigEndian.Uint64(b[8:])),
+		to:         int(binary.BigEndian.Uint64(b[16:])),
+		writeNo:    int(binary.BigEndian.Uint64(b[24:])),
+		writeIndex: int(binary.BigEndian.Uint64(b[32:])),
+		length:     int(binary.BigEndian.Uint32(b[40:])),
+		crc:        binary.BigEndian.Uint32(b[44:]),
+	}
+}
+
+func (this *DQueueFs) delayDir() string {
+	return this.path + "/" + DELAY_DIR
+}
+
+func (this *DQueueFs) bucketFile(bucket int64) string {
+	return fmt.Sprintf("%s/%d.db", this.delayDir(), bucket)
+}
+
+// 桶的宽度,毫秒
+func (this *DQueueFs) bucketWidth() int64 {
+	width := int64(this.conf.DelayBucket / time.Millisecond)
+	if width <= 0 {
+		width = int64(DEFAULT_DELAY_BUCKET / time.Millisecond)
+	}
+	return width
+}
+
+// 写入一批延迟到notBefore以后才能出队的数据,投递时间已经到了的话直接写入队列
+// 同一批数据原子的写入同一个桶,返回队列长度
+func (this *DQueueFs) PushDelayed(bss [][]byte, notBefore time.Time) (int, error) {
+	length, err := this.pushDelayed(bss, nil, notBefore)
+	return this.totalLen(length), err
+}
+
+// 写入一条带消息头的延迟数据
+func (this *DQueueFs) PushDelayedWithHeaders(bs []byte, headers map[string]string, notBefore time.Time) (int, error) {
+	if err := checkHeaders(headers); err != nil {
+		return 0, err
+	}
+	length, err := this.pushDelayed([][]byte{bs}, headers, notBefore)
+	return this.totalLen(length), err
+}
+
+func (this *DQueueFs) pushDelayed(bss [][]byte, headers map[string]string, notBefore time.Time) (int, error) {
+	if !notBefore.After(time.Now()) {
+		return this.submit(&pushReq{bss: bss, headers: headers})
+	}
+	ms := notBefore.UnixNano() / int64(time.Millisecond)
+	width := this.bucketWidth()
+	bucket := ms - ms%width
+	this.ylock.Lock()
+	// 等锁期间桶可能已经到期并且开始投递,不能再写入这个桶,直接写入队列
+	if bucket <= this.sealed {
+		this.ylock.Unlock()
+		return this.submit(&pushReq{bss: bss, headers: headers})
+	}
+	defer this.ylock.Unlock()
+	if this.isClosed() {
+		return this.idx.GetLength(), ErrClosed
+	}
+	dbs, err := this.delayWriter(bucket)
+	if err != nil {
+		return this.idx.GetLength(), err
+	}
+	for i, bs := range bss {
+		// 桶里的记录用写入时间字段保存投递时间
+		e := &db.Entry{Data: bs, Time: notBefore.UnixNano(), Headers: headers}
+		if i < len(bss)-1 {
+			e.Flags = db.FLAG_MORE
+		}
+		if err = dbs.Append(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = dbs.Flush()
+	}
+	if err != nil {
+		dbs.Discard()
+		return this.idx.GetLength(), err
+	}
+	if this.conf.Sync == SYNC_ALWAYS {
+		if err := dbs.Sync(); err != nil {
+			return this.idx.GetLength(), err
+		}
+	}
+	atomic.AddInt64(&this.delayed, int64(len(bss)))
+	if !this.buckets[bucket] {
+		this.buckets[bucket] = true
+		// 新的桶可能比正在等待的桶更早
+		select {
+		case this.delayEvent <- true:
+		default:
+		}
+	}
+	return this.idx.GetLength(), nil
+}
+
+// 获取桶的数据文件,调用者需要持有ylock
+func (this *DQueueFs) delayWriter(bucket int64) (*db.DQueueDB, error) {
+	if dbs := this.delays[bucket]; dbs != nil {
+		return dbs, nil
+	}
+	if len(this.delays) >= MAX_DELAY_WRITERS {
+		this.closeDelayWriters()
+	}
+	dbs := this.openDB(this.bucketFile(bucket), 0)
+	if dbs == nil {
+		return nil, fmt.Errorf("open delay bucket %d failed", bucket)
+	}
+	dbs.SetLimit(db.MAX_SEGMENT_SIZE)
+	// 截断崩溃时没有写完整的批次
+	if end, _ := dbs.Scan(0); end < dbs.Size() {
+		log.Println("recover", this.path, "truncate delay bucket", bucket, "from", dbs.Size(), "to", end)
+		if err := dbs.Truncate(end); err != nil {
+			dbs.Close()
+			return nil, err
+		}
+	}
+	this.delays[bucket] = dbs
+	return dbs, nil
+}
+
+// 关闭所有正在写的桶,调用者需要持有ylock
+func (this *DQueueFs) closeDelayWriters() error {
+	var err error
+	for bucket, dbs := range this.delays {
+		if e := dbs.Sync(); err == nil {
+			err = e
+		}
+		if e := dbs.Close(); err == nil {
+			err = e
+		}
+		delete(this.delays, bucket)
+	}
+	return err
+}
+
+// 启动时载入所有的桶,恢复没有完成的移动
+func (this *DQueueFs) loadDelay() error {
+	files, err := ioutil.ReadDir(this.delayDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".db") {
+			continue
+		}
+		bucket, err := strconv.ParseInt(strings.TrimSuffix(name, ".db"), 10, 64)
+		if err != nil {
+			continue
+		}
+		this.buckets[bucket] = true
+	}
+	bs, err := ioutil.ReadFile(this.delayDir() + "/dqueue.delay")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	s := decodeDelayState(bs)
+	if s == nil || s.to <= s.offset {
+		return nil
+	}
+	// 批次已经写入队列的话跳过这个批次,否则从offset重新移动
+	if this.delayPushed(s) {
+		s.offset = s.to
+	}
+	return this.writeDelayState(&delayState{bucket: s.bucket, offset: s.offset})
+}
+
+// 判断正在移动的批次是否已经写入队列,调用者需要在recover以后调用
+func (this *DQueueFs) delayPushed(s *delayState) bool {
+	if this.idx.GetWriteNo() < s.writeNo ||
+		(this.idx.GetWriteNo() == s.writeNo && this.idx.GetWriteIndex() <= s.writeIndex) {
+		return false
+	}
+	dbNo, pos := s.writeNo, s.writeIndex
+	for i := 0; i < 2 && dbNo <= this.idx.GetWriteNo(); i++ {
+		dbs := this.segment(dbNo)
+		if dbs == nil {
+			return false
+		}
+		bs, _, err := dbs.ReadAt(pos)
+		if err == nil {
+			return len(bs) == s.length && crc32.ChecksumIEEE(bs) == s.crc
+		}
+		if err != db.ErrNew && err != db.ErrEmpty {
+			return false
+		}
+		// 移动之前的文件已经写满,数据写在了下一个文件
+		dbNo, pos = dbNo+1, 0
+	}
+	return false
+}
+
+func (this *DQueueFs) writeDelayState(s *delayState) error {
+	if this.delayFp == nil {
+		fp, err := os.OpenFile(this.delayDir()+"/dqueue.delay", os.O_CREATE|os.O_RDWR, 0660)
+		if err != nil {
+			return err
+		}
+		this.delayFp = fp
+	}
+	if _, err := this.delayFp.WriteAt(encodeDelayState(s), 0); err != nil {
+		return err
+	}
+	return this.delayFp.Sync()
+}
+
+func (this *DQueueFs) readDelayState() *delayState {
+	bs, err := ioutil.ReadFile(this.delayDir() + "/dqueue.delay")
+	if err != nil {
+		return nil
+	}
+	return decodeDelayState(bs)
+}
+
+// 按照投递时间排序的桶
+func (this *DQueueFs) sortedBuckets() []int64 {
+	this.ylock.Lock()
+	defer this.ylock.Unlock()
+	buckets := make([]int64, 0, len(this.buckets))
+	for bucket := range this.buckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	return buckets
+}
+
+func (this *DQueueFs) delayLoop() {
+	defer this.loops.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-this.delayEvent:
+		case <-this.closed:
+			return
+		}
+		wait := this.dispatchDelayed()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if wait >= 0 {
+			timer.Reset(wait)
+		}
+	}
+}
+
+// 把到期的桶移动到队列,返回到下一个桶到期的时间,没有桶的话返回-1
+func (this *DQueueFs) dispatchDelayed() time.Duration {
+	width := this.bucketWidth()
+	for _, bucket := range this.sortedBuckets() {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		if bucket+width > now {
+			return time.Duration(bucket+width-now) * time.Millisecond
+		}
+		if this.isClosed() {
+			return -1
+		}
+		if err := this.dispatchBucket(bucket); err != nil {
+			log.Println("delay", this.path, "bucket", bucket, err)
+			return DELAY_RETRY
+		}
+	}
+	return -1
+}
+
+// 按批次把一个桶移动到队列,全部移动以后删除这个桶
+func (this *DQueueFs) dispatchBucket(bucket int64) error {
+	// 封住到期的桶,之后的写入直接进入队列,关闭正在写的文件
+	this.ylock.Lock()
+	if bucket > this.sealed {
+		this.sealed = bucket
+	}
+	if dbs := this.delays[bucket]; dbs != nil {
+		dbs.Sync()
+		dbs.Close()
+		delete(this.delays, bucket)
+	}
+	this.ylock.Unlock()
+	file := this.bucketFile(bucket)
+	if _, err := os.Stat(file); err == nil {
+		dbs := this.openDB(file, 0)
+		if dbs == nil {
+			return fmt.Errorf("open delay bucket %d failed", bucket)
+		}
+		dbs.SetLimit(db.MAX_SEGMENT_SIZE)
+		offset := 0
+		if s := this.readDelayState(); s != nil && s.bucket == bucket {
+			offset = s.offset
+		}
+		for {
+			to, bss, headers, err := readDelayBatch(dbs, offset)
+			if err != nil {
+				// 桶里不完整的数据不会再被写完
+				log.Println("delay", this.path, "bucket", bucket, "drop from", offset, err)
+			}
+			if len(bss) == 0 {
+				break
+			}
+			if err := this.pushDelayBatch(bucket, offset, to, bss, headers); err != nil {
+				dbs.Close()
+				return err
+			}
+			offset = to
+		}
+		dbs.Close()
+	}
+	this.ylock.Lock()
+	defer this.ylock.Unlock()
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(this.buckets, bucket)
+	return nil
+}
+
+// 从offset开始读完整的批次,返回批次的结束位置
+func readDelayBatch(dbs *db.DQueueDB, offset int) (int, [][]byte, []map[string]string, error) {
+	var bss [][]byte
+	var headers []map[string]string
+	to, size := offset, 0
+	pos, pending := offset, 0
+	for len(bss)-pending < DELAY_BATCH && size < DELAY_BATCH_SIZE {
+		e, next, err := dbs.ReadEntryAt(pos)
+		if err == db.ErrEmpty || err == db.ErrNew {
+			break
+		}
+		if err != nil {
+			return to, bss[:len(bss)-pending], headers[:len(headers)-pending], err
+		}
+		bss = append(bss, e.Data)
+		headers = append(headers, e.Headers)
+		pos = next
+		pending++
+		if e.Flags&db.FLAG_MORE == 0 {
+			to = pos
+			size = to - offset
+			pending = 0
+		}
+	}
+	return to, bss[:len(bss)-pending], headers[:len(headers)-pending], nil
+}
+
+// 原子的写入一个批次,写入之前持久化移动的状态,崩溃以后不会重复写入或者丢失
+func (this *DQueueFs) pushDelayBatch(bucket int64, offset int, to int, bss [][]byte, headers []map[string]string) error {
+	this.wlock.Lock()
+	defer this.wlock.Unlock()
+	if this.isClosed() {
+		return ErrClosed
+	}
+	s := &delayState{
+		bucket:     bucket,
+		offset:     offset,
+		to:         to,
+		writeNo:    this.idx.GetWriteNo(),
+		writeIndex: this.idx.GetWriteIndex(),
+		length:     len(bss[0]),
+		crc:        crc32.ChecksumIEEE(bss[0]),
+	}
+	if err := this.writeDelayState(s); err != nil {
+		return err
+	}
+	req := &pushReq{bss: bss, each: headers}
+	this.commit([]*pushReq{req})
+	if req.err != nil {
+		return req.err
+	}
+	atomic.AddInt64(&this.dispatched, int64(len(bss)))
+	return this.writeDelayState(&delayState{bucket: bucket, offset: to})
+}
+
+func (this *DQueueFs) delayStats() map[string]interface{} {
+	this.ylock.Lock()
+	defer this.ylock.Unlock()
+	stats := make(map[string]interface{}, 3)
+	stats["buckets"] = len(this.buckets)
+	stats["delayed"] = atomic.LoadInt64(&this.delayed)
+	stats["dispatched"] = atomic.LoadInt64(&this.dispatched)
+	return stats
+}
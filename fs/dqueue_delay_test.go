@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"github.com/wudikua/dqueue/db"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+)
+
+// 等待延迟消息到期,超时返回nil
+func popWait(fs *DQueueFs, timeout time.Duration) *Record {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if r, err := fs.Pop(); err == nil {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func Test_PushDelayed(t *testing.T) {
+	os.RemoveAll("test_delay")
+	conf := DefaultConfig()
+	conf.DelayBucket = 100 * time.Millisecond
+	fs := NewInstanceWithConfig("test_delay", conf)
+	notBefore := time.Now().Add(300 * time.Millisecond)
+	if _, err := fs.PushDelayedWithHeaders([]byte("later"), map[string]string{"type": "job"}, notBefore); err != nil {
+		t.Fail()
+	}
+	// 投递时间已经过了的数据直接写入队列
+	fs.PushDelayed([][]byte{[]byte("now")}, time.Now().Add(-time.Second))
+	r, err := fs.Pop()
+	if err != nil || string(r.Data) != "now" {
+		t.Fail()
+	}
+	if _, err := fs.Pop(); err != db.ErrEmpty {
+		t.Fail()
+	}
+	r = popWait(fs, 2*time.Second)
+	if r == nil || string(r.Data) != "later" || r.Headers["type"] != "job" || time.Now().Before(notBefore) {
+		t.Fail()
+	}
+	if _, err := os.Stat(fs.delayDir() + "/dqueue.delay"); err != nil {
+		t.Fail()
+	}
+	// 桶在数据写入队列以后才删除
+	for i := 0; i < 100 && len(fs.sortedBuckets()) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(fs.sortedBuckets()) != 0 {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 重启以后没有到期的延迟消息还在
+func Test_DelayRestart(t *testing.T) {
+	os.RemoveAll("test_delay")
+	conf := DefaultConfig()
+	conf.DelayBucket = 100 * time.Millisecond
+	fs := NewInstanceWithConfig("test_delay", conf)
+	fs.PushDelayed([][]byte{[]byte("abc"), []byte("def")}, time.Now().Add(300*time.Millisecond))
+	fs.Close()
+
+	fs = NewInstanceWithConfig("test_delay", conf)
+	for _, v := range []string{"abc", "def"} {
+		r := popWait(fs, 2*time.Second)
+		if r == nil || string(r.Data) != v {
+			t.Fail()
+		}
+	}
+	fs.Close()
+}
+
+// 模拟写入队列以后、提交投递状态之前崩溃
+func Test_DelayRecoverPushed(t *testing.T) {
+	os.RemoveAll("test_delay")
+	conf := DefaultConfig()
+	conf.DelayBucket = time.Hour
+	fs := NewInstanceWithConfig("test_delay", conf)
+	fs.PushDelayed([][]byte{[]byte("abc")}, time.Now().Add(time.Minute))
+	bucket := fs.sortedBuckets()[0]
+	fs.ylock.Lock()
+	fs.closeDelayWriters()
+	fs.ylock.Unlock()
+	fi, _ := os.Stat(fs.bucketFile(bucket))
+	end := int(fi.Size())
+	w := fs.idx.GetWriteIndex()
+	fs.PushBatch([][]byte{[]byte("abc")})
+	fs.writeDelayState(&delayState{
+		bucket:     bucket,
+		to:         end,
+		writeNo:    fs.idx.GetWriteNo(),
+		writeIndex: w,
+		length:     3,
+		crc:        crc32.ChecksumIEEE([]byte("abc")),
+	})
+
+	fs = NewInstanceWithConfig("test_delay", conf)
+	if s := fs.readDelayState(); s == nil || s.offset != end || s.to != 0 {
+		t.Fail()
+	}
+	if err := fs.dispatchBucket(bucket); err != nil {
+		t.Fail()
+	}
+	if fs.idx.GetLength() != 1 {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 模拟写入队列之前崩溃
+func Test_DelayRecoverNotPushed(t *testing.T) {
+	os.RemoveAll("test_delay")
+	conf := DefaultConfig()
+	conf.DelayBucket = time.Hour
+	fs := NewInstanceWithConfig("test_delay", conf)
+	fs.PushDelayed([][]byte{[]byte("abc")}, time.Now().Add(time.Minute))
+	bucket := fs.sortedBuckets()[0]
+	fs.ylock.Lock()
+	fs.closeDelayWriters()
+	fs.ylock.Unlock()
+	fs.writeDelayState(&delayState{
+		bucket:     bucket,
+		to:         100,
+		writeNo:    fs.idx.GetWriteNo(),
+		writeIndex: fs.idx.GetWriteIndex(),
+		length:     3,
+		crc:        crc32.ChecksumIEEE([]byte("abc")),
+	})
+
+	fs = NewInstanceWithConfig("test_delay", conf)
+	if err := fs.dispatchBucket(bucket); err != nil {
+		t.Fail()
+	}
+	r, err := fs.Pop()
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+	if _, err := os.Stat(fs.bucketFile(bucket)); err == nil {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 开始投递以后写入同一个桶的数据直接进入队列,不会随着桶被删除
+func Test_DelaySealed(t *testing.T) {
+	os.RemoveAll("test_delay")
+	conf := DefaultConfig()
+	conf.DelayBucket = time.Hour
+	fs := NewInstanceWithConfig("test_delay", conf)
+	notBefore := time.Now().Add(time.Minute)
+	ms := notBefore.UnixNano() / int64(time.Millisecond)
+	bucket := ms - ms%fs.bucketWidth()
+	fs.PushDelayed([][]byte{[]byte("a")}, notBefore)
+	// 模拟桶到期以后开始投递
+	if err := fs.dispatchBucket(bucket); err != nil {
+		t.Fail()
+	}
+	if _, err := fs.PushDelayed([][]byte{[]byte("b")}, notBefore); err != nil {
+		t.Fail()
+	}
+	if _, err := os.Stat(fs.bucketFile(bucket)); err == nil {
+		t.Fail()
+	}
+	for _, v := range []string{"a", "b"} {
+		r, err := fs.Pop()
+		if err != nil || string(r.Data) != v {
+			t.Fail()
+		}
+	}
+	fs.Close()
+}
@@ -0,0 +1,227 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// 死信消息的元数据,写在消息头里
+const (
+	// 原来的队列
+	DLQ_HEADER_QUEUE = "x-dlq-queue"
+	// 投递的次数
+	DLQ_HEADER_ATTEMPTS = "x-dlq-attempts"
+	// 最后一次失败的原因
+	DLQ_HEADER_REASON = "x-dlq-reason"
+)
+
+// 超过最大投递次数的原因
+const DLQ_REASON_ATTEMPTS = "max delivery attempts exceeded"
+
+var ErrNoDeadLetter = errors.New("dead letter queue is not configured")
+var ErrNotDeadLetter = errors.New("record is not a dead letter of the queue")
+
+// 死信队列的配置 maxAttempts queue
+func (this *DQueueFs) deadLetterFile() string {
+	return this.path + "/dqueue.dlq"
+}
+
+// 队列名,死信的元数据里记录的原队列
+func (this *DQueueFs) Name() string {
+	if this.conf.Name != "" {
+		return this.conf.Name
+	}
+	return this.path
+}
+
+// 载入死信队列的配置
+func (this *DQueueFs) loadDeadLetter() error {
+	bs, err := ioutil.ReadFile(this.deadLetterFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	fields := strings.SplitN(strings.TrimSuffix(string(bs), "\n"), " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid dead letter file %s", this.deadLetterFile())
+	}
+	maxAttempts, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return err
+	}
+	this.dlqName = fields[1]
+	this.maxAttempts = maxAttempts
+	return nil
+}
+
+// 设置死信队列和最大投递次数,投递maxAttempts次都没有确认的消息移动到死信队列,0表示不限制次数
+// queue为空时去掉死信队列,配置保存在队列目录,重启以后仍然有效
+func (this *DQueueFs) SetDeadLetter(queue string, maxAttempts int) error {
+	if maxAttempts < 0 {
+		return errors.New("max attempts must not be negative")
+	}
+	if queue != "" && queue == this.Name() {
+		return errors.New("dead letter queue must not be the queue itself")
+	}
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	file := this.deadLetterFile()
+	if queue == "" {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		line := fmt.Sprintf("%d %s\n", maxAttempts, queue)
+		if err := ioutil.WriteFile(file+".tmp", []byte(line), 0660); err != nil {
+			return err
+		}
+		if err := os.Rename(file+".tmp", file); err != nil {
+			return err
+		}
+	}
+	this.dlqName = queue
+	this.maxAttempts = maxAttempts
+	return nil
+}
+
+// 死信队列的名字和最大投递次数
+func (this *DQueueFs) DeadLetter() (string, int) {
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	return this.dlqName, this.maxAttempts
+}
+
+// 消息已经用完了投递次数,调用者需要持有alock
+func (this *DQueueFs) exhausted(d *delivery) bool {
+	return this.dlqName != "" && this.maxAttempts > 0 && d.attempts >= this.maxAttempts
+}
+
+// 要移动到死信队列的消息,持有alock的时候读出来,释放alock以后写入死信队列
+type deadLetterReq struct {
+	d      *delivery
+	e      *db.Entry
+	reason string
+	// 死信队列的名字,SetDeadLetter在alock内修改
+	queue string
+}
+
+// 读出要移动到死信队列的消息,标记为正在移动,调用者需要持有alock
+func (this *DQueueFs) prepareDeadLetter(d *delivery, reason string) (*deadLetterReq, error) {
+	if this.dlqName == "" {
+		return nil, ErrNoDeadLetter
+	}
+	dbs := this.segment(d.dbNo)
+	if dbs == nil {
+		return nil, ErrNotFound
+	}
+	e, _, err := dbs.ReadEntryAt(d.pos)
+	if err != nil {
+		return nil, err
+	}
+	d.dead = true
+	return &deadLetterReq{d: d, e: e, reason: reason, queue: this.dlqName}, nil
+}
+
+// 把消息写入死信队列并确认,调用者不能持有alock,打开和写入死信队列的时候不挡住这个队列的Reserve、Ack和Nack
+// 写入失败的话取消标记,消息继续投递
+// 写入死信队列以后确认之前崩溃的话,重启以后消息会再次投递,可能在死信队列中重复
+func (this *DQueueFs) deadLetter(req *deadLetterReq) error {
+	err := this.pushDeadLetter(req)
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	d := req.d
+	if err != nil {
+		d.dead = false
+		return err
+	}
+	if this.isClosed() {
+		return ErrClosed
+	}
+	delete(this.inflight, d.id)
+	atomic.AddInt64(&this.deadLettered, 1)
+	this.triggerRetire()
+	return this.appendAck(ACK_OP_ACK, d)
+}
+
+func (this *DQueueFs) pushDeadLetter(req *deadLetterReq) error {
+	if this.conf.OpenQueue == nil {
+		return fmt.Errorf("can not open dead letter queue %s", req.queue)
+	}
+	dlq, release, err := this.conf.OpenQueue(req.queue)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if dlq == this {
+		return errors.New("dead letter queue must not be the queue itself")
+	}
+	headers := make(map[string]string, len(req.e.Headers)+3)
+	for k, v := range req.e.Headers {
+		headers[k] = v
+	}
+	// 死信队列不继承消息ID
+	delete(headers, DEDUP_HEADER)
+	headers[DLQ_HEADER_QUEUE] = this.Name()
+	headers[DLQ_HEADER_ATTEMPTS] = strconv.Itoa(req.d.attempts)
+	headers[DLQ_HEADER_REASON] = req.reason
+	_, err = dlq.PushWithHeaders(req.e.Data, headers)
+	return err
+}
+
+// 消息处理失败并且不需要重试,立刻移动到死信队列
+func (this *DQueueFs) Reject(id uint64, reason string) error {
+	this.alock.Lock()
+	d, exists := this.inflight[id]
+	if !exists || d.dead {
+		this.alock.Unlock()
+		return ErrUnknownDelivery
+	}
+	req, err := this.prepareDeadLetter(d, reason)
+	this.alock.Unlock()
+	if err != nil {
+		return err
+	}
+	return this.deadLetter(req)
+}
+
+// 把死信队列头部的一条消息移回原来的队列dst,去掉死信的元数据
+// 头部的消息不是queue的死信时返回ErrNotDeadLetter,不移动读游标
+func (this *DQueueFs) RedriveTo(dst *DQueueFs, queue string) ([]byte, error) {
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	return this.moveHead(dst, func(e *db.Entry) (map[string]string, error) {
+		if e.Headers[DLQ_HEADER_QUEUE] != queue {
+			return nil, ErrNotDeadLetter
+		}
+		headers := make(map[string]string, len(e.Headers))
+		for k, v := range e.Headers {
+			if k != DLQ_HEADER_QUEUE && k != DLQ_HEADER_ATTEMPTS && k != DLQ_HEADER_REASON {
+				headers[k] = v
+			}
+		}
+		return headers, nil
+	})
+}
+
+func (this *DQueueFs) deadLetterStats() map[string]interface{} {
+	queue, maxAttempts := this.DeadLetter()
+	stats := make(map[string]interface{}, 3)
+	stats["queue"] = queue
+	stats["maxAttempts"] = maxAttempts
+	stats["count"] = atomic.LoadInt64(&this.deadLettered)
+	return stats
+}
+
+// 死信队列不可用的时候继续重新投递
+func (this *DQueueFs) logDeadLetter(d *delivery, err error) {
+	log.Println("dead letter", this.path, "delivery", d.id, err)
+}
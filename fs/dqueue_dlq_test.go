@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// 源队列通过OpenQueue打开死信队列
+func newDeadLetterPair() (*DQueueFs, *DQueueFs) {
+	os.RemoveAll("test_dlq_src")
+	os.RemoveAll("test_dlq")
+	dlq := NewInstance("test_dlq")
+	conf := DefaultConfig()
+	conf.Name = "src"
+	conf.OpenQueue = func(name string) (*DQueueFs, func(), error) {
+		return dlq, func() {}, nil
+	}
+	src := NewInstanceWithConfig("test_dlq_src", conf)
+	return src, dlq
+}
+
+func Test_DeadLetterAttempts(t *testing.T) {
+	src, dlq := newDeadLetterPair()
+	if err := src.SetDeadLetter("dlq", 2); err != nil {
+		t.Fail()
+	}
+	src.PushWithHeaders([]byte("abc"), map[string]string{"type": "job"})
+	for i := 0; i < 2; i++ {
+		r, err := src.Reserve(time.Minute)
+		if err != nil || r.Attempts != i+1 {
+			t.Fail()
+			return
+		}
+		src.NackWithReason(r.Id, "boom")
+	}
+	// 投递两次都失败以后移动到死信队列
+	if _, err := src.Reserve(time.Minute); err == nil {
+		t.Fail()
+	}
+	if src.Inflight() != 0 {
+		t.Fail()
+	}
+	r, err := dlq.Pop()
+	if err != nil || string(r.Data) != "abc" || r.Headers["type"] != "job" ||
+		r.Headers[DLQ_HEADER_QUEUE] != "src" || r.Headers[DLQ_HEADER_ATTEMPTS] != "2" ||
+		r.Headers[DLQ_HEADER_REASON] != "boom" {
+		t.Fail()
+	}
+}
+
+func Test_DeadLetterReject(t *testing.T) {
+	src, dlq := newDeadLetterPair()
+	src.Push([]byte("abc"))
+	r, _ := src.Reserve(time.Minute)
+	// 没有配置死信队列
+	if err := src.Reject(r.Id, "bad"); err != ErrNoDeadLetter {
+		t.Fail()
+	}
+	src.SetDeadLetter("dlq", 0)
+	if err := src.Reject(r.Id, "bad"); err != nil {
+		t.Fail()
+	}
+	if err := src.Ack(r.Id); err != ErrUnknownDelivery {
+		t.Fail()
+	}
+	if dlq.Len() != 1 {
+		t.Fail()
+	}
+}
+
+func Test_Redrive(t *testing.T) {
+	src, dlq := newDeadLetterPair()
+	src.SetDeadLetter("dlq", 1)
+	src.PushWithHeaders([]byte("abc"), map[string]string{"type": "job"})
+	r, _ := src.Reserve(time.Minute)
+	src.Reject(r.Id, "bad")
+	if _, err := dlq.RedriveTo(src, "other"); err != ErrNotDeadLetter {
+		t.Fail()
+	}
+	bs, err := dlq.RedriveTo(src, "src")
+	if err != nil || string(bs) != "abc" || dlq.Len() != 0 {
+		t.Fail()
+	}
+	rec, err := src.Pop()
+	if err != nil || string(rec.Data) != "abc" || rec.Headers["type"] != "job" || rec.Headers[DLQ_HEADER_QUEUE] != "" {
+		t.Fail()
+	}
+	// 死信队列的配置重启以后仍然有效
+	src.Close()
+	src = NewInstance("test_dlq_src")
+	if queue, maxAttempts := src.DeadLetter(); queue != "dlq" || maxAttempts != 1 {
+		t.Fail()
+	}
+}
+
+// 失败原因写在确认日志里,重启以后移动到死信队列的消息仍然带着原因
+func Test_DeadLetterReasonRestart(t *testing.T) {
+	src, dlq := newDeadLetterPair()
+	src.SetDeadLetter("dlq", 2)
+	src.Push([]byte("abc"))
+	r, _ := src.Reserve(time.Minute)
+	src.NackWithReason(r.Id, "boom")
+	// 重新投递的时候保留上一次的原因
+	r, _ = src.Reserve(time.Minute)
+	src.Nack(r.Id)
+	src.Close()
+
+	conf := DefaultConfig()
+	conf.Name = "src"
+	conf.OpenQueue = func(name string) (*DQueueFs, func(), error) {
+		return dlq, func() {}, nil
+	}
+	src = NewInstanceWithConfig("test_dlq_src", conf)
+	if src == nil || src.Inflight() != 1 {
+		t.FailNow()
+	}
+	if _, err := src.Reserve(time.Minute); err == nil {
+		t.Fail()
+	}
+	m, err := dlq.Pop()
+	if err != nil || string(m.Data) != "abc" || m.Headers[DLQ_HEADER_REASON] != "boom" {
+		t.Fail()
+	}
+}
+
+// 打开死信队列的时候不持有alock,不挡住源队列的Ack
+func Test_DeadLetterUnlocked(t *testing.T) {
+	os.RemoveAll("test_dlq_src")
+	os.RemoveAll("test_dlq")
+	dlq := NewInstance("test_dlq")
+	opening := make(chan bool)
+	opened := make(chan bool)
+	conf := DefaultConfig()
+	conf.Name = "src"
+	conf.OpenQueue = func(name string) (*DQueueFs, func(), error) {
+		opening <- true
+		<-opened
+		return dlq, func() {}, nil
+	}
+	src := NewInstanceWithConfig("test_dlq_src", conf)
+	src.SetDeadLetter("dlq", 0)
+	src.PushBatch([][]byte{[]byte("a"), []byte("b")})
+	r1, _ := src.Reserve(time.Minute)
+	r2, _ := src.Reserve(time.Minute)
+	rejected := make(chan error, 1)
+	go func() {
+		rejected <- src.Reject(r1.Id, "bad")
+	}()
+	<-opening
+	acked := make(chan error, 1)
+	go func() {
+		acked <- src.Ack(r2.Id)
+	}()
+	select {
+	case err := <-acked:
+		if err != nil {
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+	// 正在移动到死信队列的消息不能再确认
+	if err := src.Nack(r1.Id); err != ErrUnknownDelivery {
+		t.Fail()
+	}
+	close(opened)
+	if err := <-rejected; err != nil {
+		t.Fail()
+	}
+	if src.Inflight() != 0 || dlq.Len() != 1 {
+		t.Fail()
+	}
+}
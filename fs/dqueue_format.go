@@ -0,0 +1,33 @@
+package fs
+
+import (
+	"encoding/binary"
+)
+
+// 确认日志、移动日志、延迟投递状态和去重快照以magic(3)和版本号(1)开头,编号和位置都是64位
+var FORMAT_MAGIC = []byte{'d', 'q', 'f'}
+
+const (
+	FORMAT_VERSION    = 1
+	FORMAT_HEADER_LEN = 4
+)
+
+func formatHeader() []byte {
+	return append(FORMAT_MAGIC[:len(FORMAT_MAGIC):len(FORMAT_MAGIC)], FORMAT_VERSION)
+}
+
+// 是不是当前版本的格式
+func hasFormatHeader(bs []byte) bool {
+	return len(bs) >= FORMAT_HEADER_LEN && string(bs[:len(FORMAT_MAGIC)]) == string(FORMAT_MAGIC) &&
+		bs[len(FORMAT_MAGIC)] == FORMAT_VERSION
+}
+
+// 复制消息,操作数加上64位的编号和位置
+func syncMessage(op byte, fields ...int) []byte {
+	bs := make([]byte, 1+8*len(fields))
+	bs[0] = op
+	for i, f := range fields {
+		binary.BigEndian.PutUint64(bs[1+8*i:], uint64(f))
+	}
+	return bs
+}
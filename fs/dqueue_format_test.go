@@ -0,0 +1,27 @@
+package fs
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// 超过32位的编号和位置不会被截断
+func Test_FormatWide(t *testing.T) {
+	big := 1<<32 + 5
+	m := decodeMove(encodeMove(&move{readNo: big, readIndex: big + 1, writeNo: big + 2, writeIndex: big + 3, length: 3, crc: 7, dst: "q"}))
+	if m == nil || m.readNo != big || m.readIndex != big+1 || m.writeNo != big+2 || m.writeIndex != big+3 || m.dst != "q" {
+		t.Fail()
+	}
+	s := decodeDelayState(encodeDelayState(&delayState{bucket: 9, offset: big, to: big + 1, writeNo: big + 2, writeIndex: big + 3}))
+	if s == nil || s.bucket != 9 || s.offset != big || s.to != big+1 || s.writeNo != big+2 || s.writeIndex != big+3 {
+		t.Fail()
+	}
+	d := decodeDelivery(encodeDelivery(ACK_OP_RESERVE, &delivery{id: 1, dbNo: big, pos: big + 1, attempts: 2}))
+	if d.dbNo != big || d.pos != big+1 || d.attempts != 2 {
+		t.Fail()
+	}
+	bs := syncMessage(0, big)
+	if len(bs) != 9 || int(binary.BigEndian.Uint64(bs[1:])) != big {
+		t.Fail()
+	}
+}
@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"github.com/wudikua/dqueue/idx"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrGroupExists  = errors.New("consumer group already exists")
+	ErrGroupUnknown = errors.New("no such consumer group")
+)
+
+// 队列中的一条数据,DbNo和Pos可以重新定位这条数据
+// Seq是写入时分配的序号,Time是写入时间,旧格式的记录没有这两个字段,为0
+// Headers是写入时带上的消息头,没有消息头时为nil
+type Record struct {
+	DbNo    int
+	Pos     int
+	Data    []byte
+	Seq     int64
+	Time    int64
+	Headers map[string]string
+	// 数据所在的优先级通道
+	Lane int
+}
+
+func newRecord(dbNo int, pos int, e *db.Entry) *Record {
+	return &Record{DbNo: dbNo, Pos: pos, Data: e.Data, Seq: e.Seq, Time: e.Time, Headers: e.Headers}
+}
+
+// 数据的位置,格式是dbNo-pos
+func (this *Record) Id() string {
+	return fmt.Sprintf("%d-%d", this.DbNo, this.Pos)
+}
+
+// 消费组,每个消费组有自己的读游标,保存在group_名字.idx
+type group struct {
+	name string
+	idx  *idx.DQueueIndex
+	lock sync.Mutex
+}
+
+func groupFile(path string, name string) string {
+	return fmt.Sprintf("%s/group_%s.idx", path, hex.EncodeToString([]byte(name)))
+}
+
+// 载入所有消费组
+func (this *DQueueFs) loadGroups() error {
+	this.groups = make(map[string]*group)
+	files, err := filepath.Glob(this.path + "/group_*.idx")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		base := filepath.Base(file)
+		name, err := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(base, "group_"), ".idx"))
+		if err != nil {
+			continue
+		}
+		index := idx.NewInstance(file)
+		if index == nil {
+			return errors.New("load consumer group " + string(name) + " failed")
+		}
+		this.groups[string(name)] = &group{name: string(name), idx: index}
+	}
+	return nil
+}
+
+// 创建消费组,fromStart为true从最早的数据开始读,否则只读创建以后写入的数据
+func (this *DQueueFs) CreateGroup(name string, fromStart bool) error {
+	// 避免最早的数据文件同时被清理
+	this.slock.Lock()
+	defer this.slock.Unlock()
+	this.glock.Lock()
+	defer this.glock.Unlock()
+	if this.groups[name] != nil {
+		return ErrGroupExists
+	}
+	var readNo, readIndex int
+	if fromStart {
+		readNo = this.firstNo()
+	} else {
+		this.wlock.Lock()
+		readNo, readIndex = this.idx.GetWriteNo(), this.idx.GetWriteIndex()
+		this.wlock.Unlock()
+	}
+	file := groupFile(this.path, name)
+	os.Remove(file)
+	index := idx.NewInstance(file)
+	if index == nil {
+		return errors.New("create consumer group " + name + " failed")
+	}
+	index.Begin()
+	index.SetReadNo(readNo)
+	index.SetReadIndex(readIndex)
+	index.Commit()
+	this.groups[name] = &group{name: name, idx: index}
+	return nil
+}
+
+// 删除消费组
+func (this *DQueueFs) DeleteGroup(name string) error {
+	this.glock.Lock()
+	defer this.glock.Unlock()
+	if this.groups[name] == nil {
+		return ErrGroupUnknown
+	}
+	delete(this.groups, name)
+	this.triggerRetire()
+	return os.Remove(groupFile(this.path, name))
+}
+
+// 所有消费组的名字
+func (this *DQueueFs) Groups() []string {
+	this.glock.Lock()
+	defer this.glock.Unlock()
+	names := make([]string, 0, len(this.groups))
+	for name, _ := range this.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 消费组读取最多count条数据,只移动这个消费组的读游标
+// 消费组的读游标只在0号通道上,有多个优先级通道的队列返回ErrLanes
+func (this *DQueueFs) ReadGroup(name string, count int) ([]*Record, error) {
+	if err := this.checkSingleLane(); err != nil {
+		return nil, err
+	}
+	this.glock.Lock()
+	g := this.groups[name]
+	this.glock.Unlock()
+	if g == nil {
+		return nil, ErrGroupUnknown
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if this.isClosed() {
+		return nil, ErrClosed
+	}
+	records := make([]*Record, 0, count)
+	for len(records) < count {
+		dbNo, pos := g.idx.GetReadNo(), g.idx.GetReadIndex()
+		e, next, err := this.segment(dbNo).ReadEntryAt(pos)
+		if err != nil {
+			if (err == db.ErrNew || err == db.ErrEmpty) && dbNo < this.idx.GetWriteNo() {
+				// 这个db读完了,换到下一个db
+				g.idx.Begin()
+				g.idx.SetReadNo(dbNo + 1)
+				g.idx.SetReadIndex(0)
+				g.idx.Commit()
+				this.triggerRetire()
+				continue
+			}
+			if len(records) > 0 {
+				break
+			}
+			return nil, err
+		}
+		g.idx.SetReadIndex(next)
+		records = append(records, newRecord(dbNo, pos, e))
+	}
+	return records, nil
+}
+
+// 目录中最早的数据文件编号
+func (this *DQueueFs) firstNo() int {
+	first := this.idx.GetReadNo()
+	files, _ := filepath.Glob(this.path + "/dqueue_*.db")
+	for _, file := range files {
+		base := filepath.Base(file)
+		dbNo, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(base, "dqueue_"), ".db"))
+		if err == nil && dbNo < first {
+			first = dbNo
+		}
+	}
+	return first
+}
+
+func (this *DQueueFs) groupStats() map[string]interface{} {
+	this.glock.Lock()
+	defer this.glock.Unlock()
+	stats := make(map[string]interface{}, len(this.groups))
+	for name, g := range this.groups {
+		stats[name] = map[string]interface{}{
+			"readNo":    g.idx.GetReadNo(),
+			"readIndex": g.idx.GetReadIndex(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,81 @@
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_ReadGroup(t *testing.T) {
+	os.RemoveAll("test_group")
+	fs := NewInstance("test_group")
+	fs.Push([]byte("abc"))
+	if err := fs.CreateGroup("g1", true); err != nil {
+		t.Fail()
+	}
+	if err := fs.CreateGroup("g1", true); err == nil {
+		t.Fail()
+	}
+	fs.CreateGroup("g2", false)
+	fs.Push([]byte("def"))
+
+	records, err := fs.ReadGroup("g1", 10)
+	if err != nil || len(records) != 2 || string(records[0].Data) != "abc" || string(records[1].Data) != "def" {
+		t.Fail()
+	}
+	records, err = fs.ReadGroup("g2", 10)
+	if err != nil || len(records) != 1 || string(records[0].Data) != "def" {
+		t.Fail()
+	}
+	if _, err := fs.ReadGroup("g1", 10); err == nil {
+		t.Fail()
+	}
+	// 消费组不影响默认的读游标
+	r, err := fs.Pop()
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+}
+
+func Test_ReadGroupRestart(t *testing.T) {
+	os.RemoveAll("test_group")
+	fs := NewInstance("test_group")
+	fs.CreateGroup("g1", true)
+	fs.Push([]byte("abc"))
+	fs.Push([]byte("def"))
+	fs.ReadGroup("g1", 1)
+
+	fs = NewInstance("test_group")
+	if len(fs.Groups()) != 1 {
+		t.Fail()
+	}
+	records, err := fs.ReadGroup("g1", 1)
+	if err != nil || string(records[0].Data) != "def" {
+		t.Fail()
+	}
+	fs.DeleteGroup("g1")
+	if len(fs.Groups()) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_ReadGroupAcrossDb(t *testing.T) {
+	os.RemoveAll("test_group")
+	fs := NewInstance("test_group")
+	fs.CreateGroup("g1", true)
+	bs := make([]byte, 1020)
+	for i := 0; i < 1100; i++ {
+		fs.Push(bs)
+	}
+	n := 0
+	for {
+		records, err := fs.ReadGroup("g1", 100)
+		if err != nil {
+			break
+		}
+		n += len(records)
+	}
+	if n != 1100 {
+		t.Log(n)
+		t.Fail()
+	}
+}
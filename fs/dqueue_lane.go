@@ -0,0 +1,344 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"github.com/wudikua/dqueue/global"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 优先级通道,0号通道是队列自己,其他通道是队列目录下的lane_N,有自己的数据文件和读游标
+// 优先级越大越紧急,取数据的策略
+const (
+	// 严格按照优先级,高优先级的通道空了才取低优先级的通道
+	LANE_STRICT = iota
+	// 按照权重轮流取,低优先级的通道不会饿死
+	LANE_WEIGHTED
+)
+
+// 通道个数的上限
+const MAX_LANES = 16
+
+var ErrPriority = errors.New("priority out of range")
+var ErrLaneNotEmpty = errors.New("lane to remove is not empty")
+var ErrLanes = errors.New("not supported on a queue with priority lanes")
+
+func (this *DQueueFs) laneDir(lane int) string {
+	return fmt.Sprintf("%s/lane_%d", this.path, lane)
+}
+
+// 队列自己的通道配置 lanes policy weight...
+func (this *DQueueFs) lanesFile() string {
+	return this.path + "/dqueue.lanes"
+}
+
+// 解析strict或者weighted
+func ParseLanePolicy(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "strict":
+		return LANE_STRICT, nil
+	case "weighted":
+		return LANE_WEIGHTED, nil
+	}
+	return 0, fmt.Errorf("invalid lane policy %q", s)
+}
+
+func policyName(policy int) string {
+	if policy == LANE_WEIGHTED {
+		return "weighted"
+	}
+	return "strict"
+}
+
+func checkLanes(n int, policy int) error {
+	if n < 1 || n > MAX_LANES {
+		return fmt.Errorf("lanes must be between 1 and %d", MAX_LANES)
+	}
+	if policy != LANE_STRICT && policy != LANE_WEIGHTED {
+		return fmt.Errorf("invalid lane policy %d", policy)
+	}
+	return nil
+}
+
+// 载入优先级通道,队列目录下的配置优先于Config
+func (this *DQueueFs) loadLanes() error {
+	n, policy, weights := this.conf.Lanes, this.conf.LanePolicy, this.conf.LaneWeights
+	if bs, err := ioutil.ReadFile(this.lanesFile()); err == nil {
+		fields := strings.Fields(string(bs))
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid lanes file %s", this.lanesFile())
+		}
+		if n, err = strconv.Atoi(fields[0]); err != nil {
+			return err
+		}
+		if policy, err = ParseLanePolicy(fields[1]); err != nil {
+			return err
+		}
+		weights = nil
+		for _, f := range fields[2:] {
+			w, err := strconv.Atoi(f)
+			if err != nil {
+				return err
+			}
+			weights = append(weights, w)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if n < 1 {
+		n = 1
+	}
+	// 配置变小的时候已经存在的通道仍然打开,数据不会丢失
+	for i := MAX_LANES - 1; i >= n; i-- {
+		if _, err := os.Stat(this.laneDir(i) + "/dqueue.idx"); err == nil {
+			n = i + 1
+			break
+		}
+	}
+	if err := checkLanes(n, policy); err != nil {
+		return err
+	}
+	return this.openLanes(n, policy, weights)
+}
+
+// 打开n个通道,没有设置的权重是优先级加1,调用者需要持有llock
+func (this *DQueueFs) openLanes(n int, policy int, weights []int) error {
+	lanes := make([]*DQueueFs, n)
+	lanes[0] = this
+	for i := 1; i < n; i++ {
+		if i < len(this.lanes) {
+			lanes[i] = this.lanes[i]
+			continue
+		}
+		// 通道使用队列的配置,但是没有自己的通道
+		c := *this.conf
+		c.Lanes = 0
+		c.LaneWeights = nil
+		lane := NewInstanceWithConfig(this.laneDir(i), &c)
+		if lane == nil {
+			for j := len(this.lanes); j < i; j++ {
+				if j == 0 {
+					continue
+				}
+				lanes[j].Close()
+			}
+			return fmt.Errorf("open lane %d failed", i)
+		}
+		lanes[i] = lane
+	}
+	this.lanes = lanes
+	this.lanePolicy = policy
+	this.laneWeights = make([]int, n)
+	for i := range this.laneWeights {
+		if i < len(weights) && weights[i] > 0 {
+			this.laneWeights[i] = weights[i]
+		} else {
+			this.laneWeights[i] = i + 1
+		}
+	}
+	this.laneCurrent = make([]int, n)
+	return nil
+}
+
+// 修改队列的通道个数和取数据的策略,配置保存在队列目录,重启以后仍然有效
+// 减少通道的时候去掉的通道必须是空的
+func (this *DQueueFs) SetLanes(n int, policy int, weights []int) error {
+	if err := checkLanes(n, policy); err != nil {
+		return err
+	}
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	if this.isClosed() {
+		return ErrClosed
+	}
+	// 先关闭要去掉的通道,等正在进行的写入完成以后再检查是否为空
+	// PushPriority拿到通道以后不持有llock,关闭以后的写入返回ErrClosed,不会写入以后被删除
+	old := len(this.lanes)
+	for i := n; i < old; i++ {
+		this.lanes[i].Close()
+	}
+	for i := n; i < old; i++ {
+		if this.lanes[i].idx.GetLength() > 0 || this.lanes[i].Inflight() > 0 {
+			// 不为空的话重新打开关闭的通道
+			this.lanes = this.lanes[:n]
+			if err := this.openLanes(old, this.lanePolicy, this.laneWeights); err != nil {
+				return err
+			}
+			return ErrLaneNotEmpty
+		}
+	}
+	line := fmt.Sprintf("%d %s", n, policyName(policy))
+	for _, w := range weights {
+		line += fmt.Sprintf(" %d", w)
+	}
+	file := this.lanesFile()
+	if err := ioutil.WriteFile(file+".tmp", []byte(line+"\n"), 0660); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	for i := n; i < len(this.lanes); i++ {
+		os.RemoveAll(this.laneDir(i))
+	}
+	if n < len(this.lanes) {
+		this.lanes = this.lanes[:n]
+	}
+	return this.openLanes(n, policy, weights)
+}
+
+// 有多个通道的时候和LLEN一样返回所有通道的总长度,只有一个通道的时候直接返回length
+func (this *DQueueFs) totalLen(length int) int {
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	if len(this.lanes) <= 1 {
+		return length
+	}
+	length = 0
+	for _, lane := range this.lanes {
+		length += lane.idx.GetLength()
+	}
+	return length
+}
+
+// 写入一批指定优先级的数据,返回所有通道的总长度
+func (this *DQueueFs) PushPriority(bss [][]byte, priority int) (int, error) {
+	if priority == 0 {
+		return this.PushBatch(bss)
+	}
+	this.llock.Lock()
+	if priority < 0 || priority >= len(this.lanes) {
+		this.llock.Unlock()
+		return this.Len(), ErrPriority
+	}
+	lane := this.lanes[priority]
+	this.llock.Unlock()
+	if _, err := lane.PushBatch(bss); err != nil {
+		return this.Len(), err
+	}
+	// 阻塞在队列上的消费者也要被通道的写入唤醒
+	this.notifyPush()
+	return this.Len(), nil
+}
+
+// 队列有多个通道的时候返回ErrLanes,用于只支持0号通道的操作
+func (this *DQueueFs) checkSingleLane() error {
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	if len(this.lanes) > 1 {
+		return ErrLanes
+	}
+	return nil
+}
+
+// 这一次按照什么顺序尝试各个通道,调用者需要持有llock
+func (this *DQueueFs) laneOrder() []int {
+	n := len(this.lanes)
+	order := make([]int, 0, n)
+	best := -1
+	if this.lanePolicy == LANE_WEIGHTED {
+		// 平滑的加权轮询,只在有数据的通道之间分配
+		total := 0
+		for i, lane := range this.lanes {
+			if lane.idx.GetLength() <= 0 {
+				continue
+			}
+			this.laneCurrent[i] += this.laneWeights[i]
+			total += this.laneWeights[i]
+			if best < 0 || this.laneCurrent[i] > this.laneCurrent[best] {
+				best = i
+			}
+		}
+		if best >= 0 {
+			this.laneCurrent[best] -= total
+			order = append(order, best)
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		if i != best {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// 按照通道的策略取出一条数据
+func (this *DQueueFs) popLanes() (*Record, error) {
+	for _, i := range this.laneOrder() {
+		r, err := this.lanes[i].popHead()
+		if err == nil {
+			r.Lane = i
+			return r, nil
+		}
+		if err != db.ErrEmpty && err != db.ErrNew {
+			return nil, err
+		}
+	}
+	return nil, db.ErrEmpty
+}
+
+// 按照通道的策略把一条数据移动到目标队列
+func (this *DQueueFs) moveLanes(dst *DQueueFs) ([]byte, error) {
+	for _, i := range this.laneOrder() {
+		bs, err := this.lanes[i].moveHead(dst, nil)
+		if err == nil {
+			return bs, nil
+		}
+		if err != db.ErrEmpty && err != db.ErrNew {
+			return nil, err
+		}
+	}
+	return nil, db.ErrEmpty
+}
+
+// 每个通道的长度
+func (this *DQueueFs) laneStats() map[string]interface{} {
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	depth := make([]int, len(this.lanes))
+	for i, lane := range this.lanes {
+		depth[i] = lane.idx.GetLength()
+	}
+	stats := make(map[string]interface{}, 3)
+	stats["policy"] = policyName(this.lanePolicy)
+	stats["weights"] = this.laneWeights
+	stats["depth"] = depth
+	return stats
+}
+
+// 同步其他通道,通道的变更加上OP_LANE和通道编号以后写入队列的output
+func (this *DQueueFs) syncLanes(queue string, output chan interface{}, quit chan bool) {
+	this.llock.Lock()
+	lanes := this.lanes
+	this.llock.Unlock()
+	for i := 1; i < len(lanes); i++ {
+		go syncLane(i, lanes[i], queue, output, quit)
+	}
+}
+
+func syncLane(lane int, q *DQueueFs, queue string, output chan interface{}, quit chan bool) {
+	out := make(chan interface{}, 1024)
+	go q.SyncDB(queue, out, quit)
+	for {
+		select {
+		case d := <-out:
+			bs := d.([]byte)
+			msg := make([]byte, 5+len(bs))
+			msg[0] = global.OP_LANE
+			binary.BigEndian.PutUint32(msg[1:], uint32(lane))
+			copy(msg[5:], bs)
+			select {
+			case output <- msg:
+			case <-quit:
+				return
+			}
+		case <-quit:
+			return
+		}
+	}
+}
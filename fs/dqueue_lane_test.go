@@ -0,0 +1,231 @@
+package fs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_LaneStrict(t *testing.T) {
+	os.RemoveAll("test_lane")
+	fs := NewInstance("test_lane")
+	if err := fs.SetLanes(3, LANE_STRICT, nil); err != nil {
+		t.Fail()
+	}
+	fs.PushPriority([][]byte{[]byte("a")}, 0)
+	fs.PushPriority([][]byte{[]byte("b")}, 2)
+	length, err := fs.PushPriority([][]byte{[]byte("c")}, 1)
+	if err != nil || length != 3 || fs.Len() != 3 {
+		t.Fail()
+	}
+	if _, err := fs.PushPriority([][]byte{[]byte("d")}, 3); err != ErrPriority {
+		t.Fail()
+	}
+	depth := fs.Stats()["lanes"].(map[string]interface{})["depth"].([]int)
+	if depth[0] != 1 || depth[1] != 1 || depth[2] != 1 {
+		t.Fail()
+	}
+	for i, v := range []string{"b", "c", "a"} {
+		r, err := fs.Pop()
+		if err != nil || string(r.Data) != v || r.Lane != 2-i {
+			t.Fail()
+		}
+	}
+	if _, err := fs.Pop(); err == nil {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+func Test_LaneWeighted(t *testing.T) {
+	os.RemoveAll("test_lane")
+	fs := NewInstance("test_lane")
+	fs.SetLanes(2, LANE_WEIGHTED, []int{1, 3})
+	for i := 0; i < 8; i++ {
+		fs.PushPriority([][]byte{[]byte("low")}, 0)
+		fs.PushPriority([][]byte{[]byte("high")}, 1)
+	}
+	// 每4条里面3条来自高优先级的通道
+	high := 0
+	for i := 0; i < 8; i++ {
+		r, err := fs.Pop()
+		if err != nil {
+			t.Fail()
+			break
+		}
+		if r.Lane == 1 {
+			high++
+		}
+	}
+	if high != 6 {
+		t.Fail()
+	}
+	// 高优先级的通道空了以后继续取低优先级的通道
+	n := 0
+	for {
+		if _, err := fs.Pop(); err != nil {
+			break
+		}
+		n++
+	}
+	if n != 8 {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 通道的配置和数据在重启以后仍然有效
+func Test_LaneRestart(t *testing.T) {
+	os.RemoveAll("test_lane")
+	fs := NewInstance("test_lane")
+	fs.SetLanes(2, LANE_STRICT, nil)
+	fs.PushPriority([][]byte{[]byte("a")}, 0)
+	fs.PushPriority([][]byte{[]byte("b")}, 1)
+	if err := fs.SetLanes(1, LANE_STRICT, nil); err != ErrLaneNotEmpty {
+		t.Fail()
+	}
+	fs.Close()
+
+	fs = NewInstance("test_lane")
+	if fs.Len() != 2 {
+		t.Fail()
+	}
+	r, err := fs.Pop()
+	if err != nil || string(r.Data) != "b" {
+		t.Fail()
+	}
+	// 通道空了以后可以去掉
+	if err := fs.SetLanes(1, LANE_STRICT, nil); err != nil {
+		t.Fail()
+	}
+	if _, err := os.Stat("test_lane/lane_1"); err == nil {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 查看和读取范围按照取出的顺序包含所有通道
+func Test_LanePeek(t *testing.T) {
+	os.RemoveAll("test_lane")
+	fs := NewInstance("test_lane")
+	fs.SetLanes(3, LANE_STRICT, nil)
+	fs.PushPriority([][]byte{[]byte("a")}, 0)
+	fs.PushPriority([][]byte{[]byte("b")}, 2)
+	fs.PushPriority([][]byte{[]byte("c")}, 1)
+	records, err := fs.Peek(10)
+	if err != nil || len(records) != 3 {
+		t.Fail()
+		return
+	}
+	for i, v := range []string{"b", "c", "a"} {
+		if string(records[i].Data) != v || records[i].Lane != 2-i {
+			t.Fail()
+		}
+	}
+	values, err := fs.Range(1, -1)
+	if err != nil || len(values) != 2 || string(values[0]) != "c" || string(values[1]) != "a" {
+		t.Fail()
+	}
+	if v, _ := fs.Index(-1); string(v) != "a" {
+		t.Fail()
+	}
+	if fs.Len() != 3 {
+		t.Fail()
+	}
+	fs.Close()
+
+	// 加权轮询的顺序和取出的顺序一样,查看不影响轮询的状态
+	os.RemoveAll("test_lane")
+	fs = NewInstance("test_lane")
+	fs.SetLanes(2, LANE_WEIGHTED, []int{1, 2})
+	for i := 0; i < 4; i++ {
+		fs.PushPriority([][]byte{[]byte{'l', byte('0' + i)}}, 0)
+		fs.PushPriority([][]byte{[]byte{'h', byte('0' + i)}}, 1)
+	}
+	fs.Pop()
+	records, _ = fs.Peek(10)
+	if len(records) != 7 {
+		t.Fail()
+		return
+	}
+	for _, want := range records {
+		r, err := fs.Pop()
+		if err != nil || string(r.Data) != string(want.Data) {
+			t.Fail()
+		}
+	}
+	fs.Close()
+}
+
+// 确认日志和消费组只支持0号通道
+func Test_LaneReserve(t *testing.T) {
+	os.RemoveAll("test_lane")
+	fs := NewInstance("test_lane")
+	fs.Push([]byte("a"))
+	fs.CreateGroup("g", true)
+	fs.SetLanes(2, LANE_STRICT, nil)
+	fs.PushPriority([][]byte{[]byte("b")}, 1)
+	if _, err := fs.Reserve(time.Minute); err != ErrLanes {
+		t.Fail()
+	}
+	if _, err := fs.ReadGroup("g", 1); err != ErrLanes {
+		t.Fail()
+	}
+	fs.Pop()
+	fs.Pop()
+	fs.SetLanes(1, LANE_STRICT, nil)
+	fs.Push([]byte("c"))
+	r, err := fs.Reserve(time.Minute)
+	if err != nil || string(r.Data) != "c" {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+// 去掉的通道先关闭再删除,拿到通道以后的写入返回错误而不是写入以后被删除
+func Test_LaneRemoveClosed(t *testing.T) {
+	os.RemoveAll("test_lane")
+	fs := NewInstance("test_lane")
+	fs.SetLanes(2, LANE_STRICT, nil)
+	fs.PushPriority([][]byte{[]byte("a")}, 1)
+	if err := fs.SetLanes(1, LANE_STRICT, nil); err != ErrLaneNotEmpty {
+		t.Fail()
+	}
+	// 不为空的通道重新打开,仍然可以写入
+	if _, err := fs.PushPriority([][]byte{[]byte("b")}, 1); err != nil || fs.Len() != 2 {
+		t.Fail()
+	}
+	fs.Pop()
+	fs.Pop()
+	lane := fs.lanes[1]
+	if err := fs.SetLanes(1, LANE_STRICT, nil); err != nil {
+		t.Fail()
+	}
+	if _, err := lane.Push([]byte("c")); err != ErrClosed {
+		t.Fail()
+	}
+	if _, err := os.Stat("test_lane/lane_1"); err == nil {
+		t.Fail()
+	}
+}
+
+// RPUSH和RPUSHPRI一样返回所有通道的总长度
+func Test_LanePushLen(t *testing.T) {
+	os.RemoveAll("test_lane")
+	fs := NewInstance("test_lane")
+	fs.SetLanes(2, LANE_STRICT, nil)
+	fs.PushPriority([][]byte{[]byte("a")}, 1)
+	if length, err := fs.Push([]byte("b")); err != nil || length != 2 {
+		t.Fail()
+	}
+	if length, err := fs.PushPriority([][]byte{[]byte("c")}, 0); err != nil || length != 3 {
+		t.Fail()
+	}
+	if length, err := fs.PushDelayed([][]byte{[]byte("d")}, time.Now()); err != nil || length != 4 {
+		t.Fail()
+	}
+	if length, err := fs.PushPriority([][]byte{[]byte("e")}, 1); err != nil || length != fs.Len() || length != 5 {
+		t.Fail()
+	}
+	fs.Close()
+}
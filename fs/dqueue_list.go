@@ -0,0 +1,64 @@
+package fs
+
+// 队列长度,包含所有优先级通道,头部是最早写入的数据,尾部是最后写入的数据
+func (this *DQueueFs) Len() int {
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	length := this.idx.GetLength()
+	for _, lane := range this.lanes[1:] {
+		length += lane.idx.GetLength()
+	}
+	return length
+}
+
+// 读取从头部开始下标start到stop的数据,包含stop,不移动读游标
+// 下标和LRANGE一样,负数表示从尾部开始,-1是最后一条数据,需要从读游标顺序读到stop
+// 有多个通道的时候按照取出的顺序
+func (this *DQueueFs) Range(start int, stop int) ([][]byte, error) {
+	unlock := this.lockLanes()
+	defer unlock()
+	if this.isClosed() {
+		return nil, ErrClosed
+	}
+	length := 0
+	for _, lane := range this.lanes {
+		length += lane.idx.GetLength()
+	}
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop {
+		return [][]byte{}, nil
+	}
+	values := make([][]byte, 0, stop-start+1)
+	i := 0
+	err := this.walk(func(r *Record) bool {
+		if i >= start {
+			values = append(values, r.Data)
+		}
+		i++
+		return i <= stop
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// 读取从头部开始下标为index的数据,负数表示从尾部开始,不存在返回nil
+func (this *DQueueFs) Index(index int) ([]byte, error) {
+	values, err := this.Range(index, index)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	return values[0], nil
+}
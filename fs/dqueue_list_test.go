@@ -0,0 +1,43 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_Range(t *testing.T) {
+	os.RemoveAll("test_list")
+	fs := NewInstanceWithConfig("test_list", &Config{SegmentSize: 4096})
+	payload := strings.Repeat("x", 1100)
+	// 10条数据分布在多个db
+	for i := 0; i < 10; i++ {
+		fs.Push([]byte(fmt.Sprintf("%d%s", i, payload)))
+	}
+	fs.Pop()
+	if fs.Len() != 9 {
+		t.Fail()
+	}
+	values, err := fs.Range(0, -1)
+	if err != nil || len(values) != 9 || values[0][0] != '1' || values[8][0] != '9' {
+		t.Fail()
+	}
+	values, _ = fs.Range(-3, 100)
+	if len(values) != 3 || values[0][0] != '7' {
+		t.Fail()
+	}
+	if values, _ := fs.Range(5, 2); len(values) != 0 {
+		t.Fail()
+	}
+	if v, _ := fs.Index(4); v == nil || v[0] != '5' {
+		t.Fail()
+	}
+	if v, err := fs.Index(9); v != nil || err != nil {
+		t.Fail()
+	}
+	// 不移动读游标
+	if r, _ := fs.Pop(); r.Data[0] != '1' {
+		t.Fail()
+	}
+}
@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"github.com/wudikua/dqueue/idx"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+)
+
+// 移动日志 header(4) readNo(8) readIndex(8) writeNo(8) writeIndex(8) length(4) crc(4) pathLen(2) path crc(4)
+const MOVE_HEADER_LEN = FORMAT_HEADER_LEN + 42
+
+// 一次没有完成的移动
+type move struct {
+	// 源队列移动以后的读位置
+	readNo    int
+	readIndex int
+	// 目标队列移动之前的写位置
+	writeNo    int
+	writeIndex int
+	// 移动的数据
+	length int
+	crc    uint32
+	dst    string
+}
+
+func encodeMove(m *move) []byte {
+	bs := make([]byte, MOVE_HEADER_LEN+len(m.dst)+4)
+	copy(bs, formatHeader())
+	b := bs[FORMAT_HEADER_LEN:]
+	binary.BigEndian.PutUint64(b[0:], uint64(m.readNo))
+	binary.BigEndian.PutUint64(b[8:], uint64(m.readIndex))
+	binary.BigEndian.PutUint64(b[16:], uint64(m.writeNo))
+	binary.BigEndian.PutUint64(b[24:], uint64(m.writeIndex))
+	binary.BigEndian.PutUint32(b[32:], uint32(m.length))
+	binary.BigEndian.PutUint32(b[36:], m.crc)
+	binary.BigEndian.PutUint16(b[40:], uint16(len(m.dst)))
+	copy(bs[MOVE_HEADER_LEN:], m.dst)
+	binary.BigEndian.PutUint32(bs[len(bs)-4:], crc32.ChecksumIEEE(bs[:len(bs)-4]))
+	return bs
+}
+
+func decodeMove(bs []byte) *move {
+	if !hasFormatHeader(bs) || len(bs) < MOVE_HEADER_LEN+4 {
+		return nil
+	}
+	pathLen := int(binary.BigEndian.Uint16(bs[MOVE_HEADER_LEN-2:]))
+	if len(bs) < MOVE_HEADER_LEN+pathLen+4 {
+		return nil
+	}
+	bs = bs[:MOVE_HEADER_LEN+pathLen+4]
+	// 日志没有写完整,说明目标队列还没有写入
+	if binary.BigEndian.Uint32(bs[len(bs)-4:]) != crc32.ChecksumIEEE(bs[:len(bs)-4]) {
+		return nil
+	}
+	b := bs[FORMAT_HEADER_LEN:]
+	return &move{
+		readNo:     int(binary.BigEndian.Uint64(b[0:])),
+		readIndex:  int(binary.BigEndian.Uint64(b[8:])),
+		writeNo:    int(binary.BigEndian.Uint64(b[16:])),
+		writeIndex: int(binary.BigEndian.Uint64(b[24:])),
+		length:     int(binary.BigEndian.Uint32(b[32:])),
+		crc:        binary.BigEndian.Uint32(b[36:]),
+		dst:        string(bs[MOVE_HEADER_LEN : MOVE_HEADER_LEN+pathLen]),
+	}
+}
+
+// 把下一条数据原子的移动到目标队列,崩溃以后数据只会存在于其中一个队列
+// 有多个优先级通道的时候按照通道的策略选择通道
+func (this *DQueueFs) MoveTo(dst *DQueueFs) ([]byte, error) {
+	this.llock.Lock()
+	defer this.llock.Unlock()
+	if len(this.lanes) > 1 {
+		return this.moveLanes(dst)
+	}
+	return this.moveHead(dst, nil)
+}
+
+// 把这个通道头部的数据移动到目标队列,headers不为空时用它的返回值作为目标队列的消息头
+func (this *DQueueFs) moveHead(dst *DQueueFs, headers func(e *db.Entry) (map[string]string, error)) ([]byte, error) {
+	this.rlock.Lock()
+	defer this.rlock.Unlock()
+	dst.wlock.Lock()
+	defer dst.wlock.Unlock()
+	dbs, pos, e, err := this.next()
+	if err != nil {
+		return nil, err
+	}
+	bs := e.Data
+	h := e.Headers
+	if headers != nil {
+		if h, err = headers(e); err != nil {
+			dbs.SetReadPos(pos)
+			return nil, err
+		}
+	}
+	m := &move{
+		readNo:     this.idx.GetReadNo(),
+		readIndex:  dbs.GetReadPos(),
+		writeNo:    dst.idx.GetWriteNo(),
+		writeIndex: dst.idx.GetWriteIndex(),
+		length:     len(bs),
+		crc:        crc32.ChecksumIEEE(bs),
+		dst:        dst.path,
+	}
+	// 先持久化移动日志
+	if err := this.writeMove(m); err != nil {
+		dbs.SetReadPos(pos)
+		return nil, err
+	}
+	// 写目标队列
+	if _, err := dst.push(bs, h); err != nil {
+		dbs.SetReadPos(pos)
+		this.clearMove()
+		return nil, err
+	}
+	// 提交源队列的读游标
+	this.commitRead(dbs)
+	this.clearMove()
+	return bs, nil
+}
+
+func (this *DQueueFs) writeMove(m *move) error {
+	if this.moveFp == nil {
+		fp, err := os.OpenFile(this.path+"/dqueue.move", os.O_CREATE|os.O_RDWR, 0660)
+		if err != nil {
+			return err
+		}
+		this.moveFp = fp
+	}
+	if _, err := this.moveFp.WriteAt(encodeMove(m), 0); err != nil {
+		return err
+	}
+	return this.moveFp.Sync()
+}
+
+func (this *DQueueFs) clearMove() {
+	this.moveFp.Truncate(0)
+}
+
+// 启动时检查没有完成的移动,目标队列已经写入的话提交源队列的读游标
+func (this *DQueueFs) recoverMove() error {
+	bs, err := ioutil.ReadFile(this.path + "/dqueue.move")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	m := decodeMove(bs)
+	if m != nil && movePushed(m, this.keys) {
+		if this.idx.GetReadNo() != m.readNo || this.idx.GetReadIndex() != m.readIndex {
+			// 数据已经在目标队列,从源队列删除
+			this.idx.Begin()
+			this.idx.SetReadNo(m.readNo)
+			this.idx.SetReadIndex(m.readIndex)
+			this.idx.DecLength()
+			this.idx.Commit()
+			this.segment(m.readNo).SetReadPos(m.readIndex)
+		}
+	}
+	return os.Truncate(this.path+"/dqueue.move", 0)
+}
+
+// 判断移动的数据是否已经写入目标队列,目标队列和这个队列使用相同的密钥
+func movePushed(m *move, keys *db.Keyring) bool {
+	if _, err := os.Stat(m.dst + "/dqueue.idx"); err != nil {
+		return false
+	}
+	// 目标队列可能正在被使用,只读索引文件,不升级也不占用文件句柄
+	index := idx.ReadOnly(m.dst + "/dqueue.idx")
+	if index == nil {
+		return false
+	}
+	// 目标队列的写位置没有前进
+	if index.GetWriteNo() < m.writeNo ||
+		(index.GetWriteNo() == m.writeNo && index.GetWriteIndex() <= m.writeIndex) {
+		return false
+	}
+	dbNo, pos := m.writeNo, m.writeIndex
+	for i := 0; i < 2; i++ {
+		file := fmt.Sprintf("%s/dqueue_%d.db", m.dst, dbNo)
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+		dbs := db.NewInstance(file, dbNo)
+		if dbs == nil {
+			return false
+		}
+		dbs.SetKeyring(keys)
+		bs, _, err := dbs.ReadAt(pos)
+		dbs.Close()
+		if err == nil {
+			return len(bs) == m.length && crc32.ChecksumIEEE(bs) == m.crc
+		}
+		// 目标队列的数据文件大小可能不同,读到文件末尾的时候都检查下一个文件
+		if err != db.ErrNew && err != db.ErrEmpty {
+			return false
+		}
+		// 移动之前的文件已经写满,数据写在了下一个文件
+		dbNo, pos = dbNo+1, 0
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package fs
+
+import (
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func Test_MoveTo(t *testing.T) {
+	os.RemoveAll("test_src")
+	os.RemoveAll("test_dst")
+	src := NewInstance("test_src")
+	dst := NewInstance("test_dst")
+	src.Push([]byte("abc"))
+	bs, err := src.MoveTo(dst)
+	if err != nil || string(bs) != "abc" {
+		t.Fail()
+	}
+	if _, err := src.MoveTo(dst); err == nil {
+		t.Fail()
+	}
+	r, err := dst.Pop()
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+}
+
+// 模拟写完目标队列以后崩溃
+func Test_MoveRecoverPushed(t *testing.T) {
+	os.RemoveAll("test_src")
+	os.RemoveAll("test_dst")
+	src := NewInstance("test_src")
+	dst := NewInstance("test_dst")
+	src.Push([]byte("abc"))
+	src.Push([]byte("def"))
+	dbs, _, e, _ := src.next()
+	bs := e.Data
+	src.writeMove(&move{
+		readNo:     src.idx.GetReadNo(),
+		readIndex:  dbs.GetReadPos(),
+		writeNo:    dst.idx.GetWriteNo(),
+		writeIndex: dst.idx.GetWriteIndex(),
+		length:     len(bs),
+		crc:        crc32.ChecksumIEEE(bs),
+		dst:        dst.path,
+	})
+	dst.push(bs, nil)
+
+	src = NewInstance("test_src")
+	if src.idx.GetLength() != 1 {
+		t.Fail()
+	}
+	r, err := src.Pop()
+	if err != nil || string(r.Data) != "def" {
+		t.Fail()
+	}
+}
+
+// 模拟写目标队列之前崩溃
+func Test_MoveRecoverNotPushed(t *testing.T) {
+	os.RemoveAll("test_src")
+	os.RemoveAll("test_dst")
+	src := NewInstance("test_src")
+	dst := NewInstance("test_dst")
+	src.Push([]byte("abc"))
+	dbs, _, e, _ := src.next()
+	bs := e.Data
+	src.writeMove(&move{
+		readNo:     src.idx.GetReadNo(),
+		readIndex:  dbs.GetReadPos(),
+		writeNo:    dst.idx.GetWriteNo(),
+		writeIndex: dst.idx.GetWriteIndex(),
+		length:     len(bs),
+		crc:        crc32.ChecksumIEEE(bs),
+		dst:        dst.path,
+	})
+
+	src = NewInstance("test_src")
+	r, err := src.Pop()
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+	if _, err := dst.Pop(); err == nil {
+		t.Fail()
+	}
+}
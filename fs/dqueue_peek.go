@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"os"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+// 解析Record.Id返回的位置
+func ParseId(id string) (int, int, error) {
+	var dbNo, pos int
+	if _, err := fmt.Sscanf(id, "%d-%d", &dbNo, &pos); err != nil || dbNo < 0 || pos < 0 {
+		return 0, 0, fmt.Errorf("invalid record id %q", id)
+	}
+	return dbNo, pos, nil
+}
+
+// 从读游标开始沿着记录的next顺序向后读的位置,不移动读游标
+type cursor struct {
+	q    *DQueueFs
+	dbNo int
+	pos  int
+}
+
+// 读游标的位置,调用者需要持有rlock
+func (this *DQueueFs) cursor() *cursor {
+	dbNo := this.idx.GetReadNo()
+	return &cursor{q: this, dbNo: dbNo, pos: this.segment(dbNo).GetReadPos()}
+}
+
+// 读下一条记录,读到写位置返回nil
+func (this *cursor) next() (*Record, error) {
+	for {
+		e, next, err := this.q.segment(this.dbNo).ReadEntryAt(this.pos)
+		if err != nil {
+			if err == db.ErrNew || err == db.ErrEmpty {
+				if this.dbNo < this.q.idx.GetWriteNo() {
+					// 这个db读完了,换到下一个db
+					this.dbNo, this.pos = this.dbNo+1, 0
+					continue
+				}
+				return nil, nil
+			}
+			return nil, err
+		}
+		r := newRecord(this.dbNo, this.pos, e)
+		this.pos = next
+		return r, nil
+	}
+}
+
+// 锁住所有通道的读游标,按照llock和通道编号的顺序加锁,返回解锁的函数
+func (this *DQueueFs) lockLanes() func() {
+	this.llock.Lock()
+	lanes := this.lanes
+	for _, lane := range lanes {
+		lane.rlock.Lock()
+	}
+	return func() {
+		for i := len(lanes) - 1; i >= 0; i-- {
+			lanes[i].rlock.Unlock()
+		}
+		this.llock.Unlock()
+	}
+}
+
+// 按照取出的顺序读取所有通道,fn返回false时停止,不移动读游标,也不修改加权轮询的状态
+// 加权轮询的顺序从当前的状态模拟,调用者需要持有lockLanes
+func (this *DQueueFs) walk(fn func(r *Record) bool) error {
+	n := len(this.lanes)
+	cursors := make([]*cursor, n)
+	remain := make([]int, n)
+	for i, lane := range this.lanes {
+		cursors[i] = lane.cursor()
+		remain[i] = lane.idx.GetLength()
+	}
+	current := append([]int(nil), this.laneCurrent...)
+	for {
+		lane := -1
+		if this.lanePolicy == LANE_WEIGHTED && n > 1 {
+			total := 0
+			for i := range this.lanes {
+				if remain[i] <= 0 {
+					continue
+				}
+				current[i] += this.laneWeights[i]
+				total += this.laneWeights[i]
+				if lane < 0 || current[i] > current[lane] {
+					lane = i
+				}
+			}
+			if lane >= 0 {
+				current[lane] -= total
+			}
+		} else {
+			for i := n - 1; i >= 0; i-- {
+				if remain[i] > 0 {
+					lane = i
+					break
+				}
+			}
+		}
+		if lane < 0 {
+			return nil
+		}
+		r, err := cursors[lane].next()
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			// 长度和数据不一致的时候以数据为准
+			remain[lane] = 0
+			continue
+		}
+		remain[lane]--
+		r.Lane = lane
+		if !fn(r) {
+			return nil
+		}
+	}
+}
+
+// 查看头部的n条数据,不取出数据,有多个通道的时候按照取出的顺序
+func (this *DQueueFs) Peek(n int) ([]*Record, error) {
+	unlock := this.lockLanes()
+	defer unlock()
+	if this.isClosed() {
+		return nil, ErrClosed
+	}
+	records := make([]*Record, 0, n)
+	if n <= 0 {
+		return records, nil
+	}
+	err := this.walk(func(r *Record) bool {
+		records = append(records, r)
+		return len(records) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// 读取dbNo号数据文件pos位置的一条数据,pos需要是Record.Pos
+// 已经被消费但是数据文件还没有清理的数据也可以读到
+func (this *DQueueFs) ReadAt(dbNo int, pos int) (*Record, error) {
+	if this.isClosed() {
+		return nil, ErrClosed
+	}
+	if dbNo < 0 || pos < 0 || dbNo > this.idx.GetWriteNo() {
+		return nil, ErrNotFound
+	}
+	// 读的时候数据文件不会被清理
+	this.slock.Lock()
+	defer this.slock.Unlock()
+	var e *db.Entry
+	var err error
+	if dbNo >= this.idx.GetReadNo() {
+		e, _, err = this.segment(dbNo).ReadEntryAt(pos)
+	} else {
+		// 读游标之前的数据文件随时可能被清理,不放到dbs中
+		file := fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo)
+		if _, err := os.Stat(file); err != nil {
+			return nil, ErrNotFound
+		}
+		dbold := this.openDB(file, dbNo)
+		if dbold == nil {
+			return nil, ErrNotFound
+		}
+		dbold.SetLimit(dbold.GetWritePos())
+		e, _, err = dbold.ReadEntryAt(pos)
+		dbold.Close()
+	}
+	if err != nil {
+		if err == db.ErrNew || err == db.ErrEmpty {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return newRecord(dbNo, pos, e), nil
+}
@@ -0,0 +1,58 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_Peek(t *testing.T) {
+	os.RemoveAll("test_peek")
+	fs := NewInstanceWithConfig("test_peek", &Config{SegmentSize: 4096, Retire: RETIRE_KEEP})
+	payload := strings.Repeat("x", 1100)
+	for i := 0; i < 6; i++ {
+		fs.Push([]byte(fmt.Sprintf("%d%s", i, payload)))
+	}
+	records, err := fs.Peek(2)
+	if err != nil || len(records) != 2 || records[0].Data[0] != '0' || records[1].Data[0] != '1' {
+		t.Fail()
+	}
+	// 不移动读游标
+	if r, _ := fs.Pop(); r.Data[0] != '0' {
+		t.Fail()
+	}
+	records, _ = fs.Peek(10)
+	if len(records) != 5 || records[4].DbNo != 2 {
+		t.Fail()
+	}
+
+	// 通过位置重新读取
+	dbNo, pos, err := ParseId(records[4].Id())
+	if err != nil {
+		t.Fail()
+	}
+	r, err := fs.ReadAt(dbNo, pos)
+	if err != nil || r.Data[0] != '5' || r.Id() != records[4].Id() {
+		t.Fail()
+	}
+	// 已经消费的数据
+	if r, err := fs.ReadAt(1, 0); err != nil || r.Data[0] != '0' {
+		t.Fail()
+	}
+	for i := 0; i < 5; i++ {
+		fs.Pop()
+	}
+	if r, err := fs.ReadAt(1, 0); err != nil || r.Data[0] != '0' {
+		t.Fail()
+	}
+	if _, err := fs.ReadAt(dbNo, 100000); err != ErrNotFound {
+		t.Fail()
+	}
+	if _, err := fs.ReadAt(10, 0); err != ErrNotFound {
+		t.Fail()
+	}
+	if _, _, err := ParseId("abc"); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"log"
+)
+
+// 启动时检查正在写的数据文件,截断没有写完整的记录,修正索引的写位置和队列长度
+func (this *DQueueFs) recover() {
+	dbNo := this.idx.GetWriteNo()
+	dbs := this.segment(dbNo)
+	size := dbs.Size()
+	w := this.idx.GetWriteIndex()
+	if w <= size {
+		// 索引的写位置之后可能还有已经写入但是没有更新索引的数据
+		end, count := dbs.Scan(w)
+		if end < size {
+			log.Println("recover", this.path, "truncate db", dbNo, "from", size, "to", end)
+			dbs.Truncate(end)
+		}
+		if end != w {
+			log.Println("recover", this.path, "write index", w, "to", end, "found", count, "records")
+			this.idx.Begin()
+			this.idx.SetWriteIndex(end)
+			this.idx.AddLength(count)
+			// 这些记录的序号是从索引的seq开始连续分配的
+			this.idx.AddSeq(count)
+			this.idx.Commit()
+			dbs.SetWritePos(end)
+		}
+		return
+	}
+	// 索引的写位置超过了数据文件,从头检查这个数据文件
+	end, _ := dbs.Scan(0)
+	log.Println("recover", this.path, "write index", w, "beyond db", dbNo, "size", size, "reset to", end)
+	if end < size {
+		dbs.Truncate(end)
+	}
+	this.idx.Begin()
+	this.idx.SetWriteIndex(end)
+	dbs.SetWritePos(end)
+	if this.idx.GetReadNo() == dbNo && this.idx.GetReadIndex() > end {
+		this.idx.SetReadIndex(end)
+		dbs.SetReadPos(end)
+	}
+	// 重新计算队列长度
+	this.idx.SetLength(this.countFrom(this.idx.GetReadNo(), this.idx.GetReadIndex()))
+	this.idx.Commit()
+}
+
+// 从dbNo的pos位置开始到写位置的记录数
+func (this *DQueueFs) countFrom(dbNo int, pos int) int {
+	count := 0
+	for i := dbNo; i <= this.idx.GetWriteNo(); i++ {
+		from := 0
+		if i == dbNo {
+			from = pos
+		}
+		_, n := this.segment(i).Scan(from)
+		count += n
+	}
+	return count
+}
@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"errors"
+	"github.com/wudikua/dqueue/db"
+	"os"
+	"testing"
+)
+
+// 模拟数据写入以后索引还没有更新就崩溃
+func Test_RecoverUnindexed(t *testing.T) {
+	os.RemoveAll("test_recover")
+	fs := NewInstance("test_recover")
+	fs.Push([]byte("abc"))
+	w := fs.idx.GetWriteIndex()
+	fs.Push([]byte("def"))
+	fs.idx.SetWriteIndex(w)
+	fs.idx.SetLength(1)
+
+	fs = NewInstance("test_recover")
+	if fs.idx.GetLength() != 2 {
+		t.Fail()
+	}
+	for _, v := range []string{"abc", "def"} {
+		r, err := fs.Pop()
+		if err != nil || string(r.Data) != v {
+			t.Fail()
+		}
+	}
+}
+
+// 模拟最后一条记录只写了一半
+func Test_RecoverTornTail(t *testing.T) {
+	os.RemoveAll("test_recover")
+	fs := NewInstance("test_recover")
+	fs.Push([]byte("abc"))
+	w := fs.idx.GetWriteIndex()
+	fs.Push([]byte("def"))
+	os.Truncate("test_recover/dqueue_1.db", int64(fs.idx.GetWriteIndex()-1))
+	fs.idx.SetWriteIndex(w)
+	fs.idx.SetLength(1)
+
+	fs = NewInstance("test_recover")
+	if fs.idx.GetLength() != 1 || fs.idx.GetWriteIndex() != w {
+		t.Fail()
+	}
+	if fi, _ := os.Stat("test_recover/dqueue_1.db"); fi.Size() != int64(w) {
+		t.Fail()
+	}
+	fs.Push([]byte("ghi"))
+	for _, v := range []string{"abc", "ghi"} {
+		r, err := fs.Pop()
+		if err != nil || string(r.Data) != v {
+			t.Fail()
+		}
+	}
+}
+
+// 模拟一批数据只写入了一部分
+func Test_RecoverPartialBatch(t *testing.T) {
+	os.RemoveAll("test_recover")
+	fs := NewInstance("test_recover")
+	fs.Push([]byte("abc"))
+	w := fs.idx.GetWriteIndex()
+	fs.PushBatch([][]byte{[]byte("d"), []byte("e"), []byte("f")})
+	// 去掉批次的最后一条记录
+	os.Truncate("test_recover/dqueue_1.db", int64(fs.idx.GetWriteIndex()-db.RECORD_HEADER_LEN-1))
+	fs.idx.SetWriteIndex(w)
+	fs.idx.SetLength(1)
+
+	fs = NewInstance("test_recover")
+	if fs.idx.GetLength() != 1 || fs.idx.GetWriteIndex() != w {
+		t.Fail()
+	}
+}
+
+// 模拟索引超过了数据文件
+func Test_RecoverIndexBeyondData(t *testing.T) {
+	os.RemoveAll("test_recover")
+	fs := NewInstance("test_recover")
+	fs.Push([]byte("abc"))
+	w := fs.idx.GetWriteIndex()
+	fs.Push([]byte("def"))
+	fs.Push([]byte("ghi"))
+	os.Truncate("test_recover/dqueue_1.db", int64(w+3))
+
+	fs = NewInstance("test_recover")
+	if fs.idx.GetLength() != 1 || fs.idx.GetWriteIndex() != w {
+		t.Fail()
+	}
+	r, err := fs.Pop()
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+}
+
+// 损坏的数据返回带数据文件编号和位置的错误,和队列为空区分开
+func Test_PopCorrupt(t *testing.T) {
+	os.RemoveAll("test_recover")
+	fs := NewInstance("test_recover")
+	fs.Push([]byte("abc"))
+	fp, _ := os.OpenFile("test_recover/dqueue_1.db", os.O_RDWR, 0666)
+	fp.WriteAt([]byte("x"), db.RECORD_HEADER_LEN)
+	fp.Close()
+	_, err := fs.Pop()
+	var e *db.Error
+	if !errors.As(err, &e) || !errors.Is(err, db.ErrCorrupt) || e.DbNo != 1 || e.Pos != 0 {
+		t.Log(err)
+		t.Fail()
+	}
+	fs.Close()
+	os.RemoveAll("test_recover")
+	fs = NewInstance("test_recover")
+	if _, err := fs.Pop(); err != db.ErrEmpty {
+		t.Fail()
+	}
+}
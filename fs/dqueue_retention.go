@@ -0,0 +1,169 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 积压数据超过上限时的行为
+const (
+	// 拒绝写入,返回ErrLimit
+	RETENTION_REJECT = iota
+	// 丢弃最早的数据文件
+	RETENTION_DROP
+)
+
+var retentionPolicyNames = map[int]string{
+	RETENTION_REJECT: "reject",
+	RETENTION_DROP:   "drop",
+}
+
+var ErrLimit = errors.New("queue limit exceeded")
+
+// 统计读游标所在的数据文件到正在写的数据文件的大小
+func (this *DQueueFs) loadBacklog() {
+	var backlog int64
+	for i := this.idx.GetReadNo(); i <= this.idx.GetWriteNo(); i++ {
+		if fi, err := os.Stat(fmt.Sprintf("%s/dqueue_%d.db", this.path, i)); err == nil {
+			backlog += fi.Size()
+		}
+	}
+	atomic.StoreInt64(&this.backlog, backlog)
+}
+
+// 写入req以后是否超过上限,count和buffered是同一批次中还没有Flush的记录数和字节数
+func (this *DQueueFs) overLimit(req *pushReq, count int, buffered int) bool {
+	if this.conf.MaxRecords > 0 && this.idx.GetLength()+count+len(req.bss) > this.conf.MaxRecords {
+		return true
+	}
+	if this.conf.MaxBytes > 0 {
+		size := atomic.LoadInt64(&this.backlog) + int64(buffered)
+		for _, bs := range req.bss {
+			size += int64(len(bs))
+		}
+		if size > this.conf.MaxBytes {
+			return true
+		}
+	}
+	return atomic.LoadInt32(&this.expired) == 1
+}
+
+// 最早的没有消费完的数据文件最后一次写入以后经过的时间
+func (this *DQueueFs) oldestAge() time.Duration {
+	fi, err := os.Stat(fmt.Sprintf("%s/dqueue_%d.db", this.path, this.idx.GetReadNo()))
+	if err != nil {
+		return 0
+	}
+	return time.Since(fi.ModTime())
+}
+
+// 通知后台协程检查积压数据
+func (this *DQueueFs) triggerRetention() {
+	select {
+	case this.retentionEvent <- true:
+	default:
+	}
+}
+
+// 设置了上限时每秒检查一次,数据文件的最后写入时间超过MaxAge才算过期
+func (this *DQueueFs) retentionLoop() {
+	defer this.loops.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-this.retentionEvent:
+		case <-this.closed:
+			return
+		}
+		this.enforce()
+	}
+}
+
+// 检查积压数据,RETENTION_DROP时丢弃最早的数据文件直到不超过上限
+// 正在写的数据文件不会被丢弃,所以上限的精度是一个数据文件
+func (this *DQueueFs) enforce() {
+	expired := this.conf.MaxAge > 0 && this.oldestAge() > this.conf.MaxAge
+	if this.conf.Retention == RETENTION_REJECT {
+		var v int32
+		if expired {
+			v = 1
+		}
+		atomic.StoreInt32(&this.expired, v)
+		return
+	}
+	drop := false
+	for {
+		this.alock.Lock()
+		this.rlock.Lock()
+		readNo := this.idx.GetReadNo()
+		over := expired ||
+			(this.conf.MaxBytes > 0 && atomic.LoadInt64(&this.backlog) > this.conf.MaxBytes) ||
+			(this.conf.MaxRecords > 0 && this.idx.GetLength() > this.conf.MaxRecords)
+		if !over || readNo >= this.idx.GetWriteNo() {
+			this.rlock.Unlock()
+			this.alock.Unlock()
+			break
+		}
+		this.drop(readNo)
+		this.rlock.Unlock()
+		this.alock.Unlock()
+		drop = true
+		expired = this.conf.MaxAge > 0 && this.oldestAge() > this.conf.MaxAge
+	}
+	if drop {
+		this.triggerRetire()
+	}
+}
+
+// 丢弃编号为dbNo的数据文件中还没有消费的数据,读游标移动到下一个数据文件
+// 消费组和没有确认的消息也跳过这个数据文件,调用者需要持有alock和rlock
+func (this *DQueueFs) drop(dbNo int) {
+	dbs := this.segment(dbNo)
+	_, count := dbs.Scan(this.idx.GetReadIndex())
+	log.Println("retention", this.path, "drop db", dbNo, count, "records")
+	this.idx.Begin()
+	this.idx.SetReadNo(dbNo + 1)
+	this.idx.SetReadIndex(0)
+	this.idx.AddLength(-count)
+	this.idx.Commit()
+	this.segment(dbNo + 1).SetReadPos(0)
+	atomic.AddInt64(&this.backlog, -int64(dbs.GetWritePos()))
+	atomic.AddInt64(&this.dropped, int64(count))
+	for id, d := range this.inflight {
+		if d.dbNo <= dbNo {
+			delete(this.inflight, id)
+			this.appendAck(ACK_OP_ACK, d)
+		}
+	}
+	this.glock.Lock()
+	for _, g := range this.groups {
+		g.lock.Lock()
+		if g.idx.GetReadNo() <= dbNo {
+			g.idx.Begin()
+			g.idx.SetReadNo(dbNo + 1)
+			g.idx.SetReadIndex(0)
+			g.idx.Commit()
+		}
+		g.lock.Unlock()
+	}
+	this.glock.Unlock()
+}
+
+func (this *DQueueFs) retentionStats() map[string]interface{} {
+	stats := make(map[string]interface{}, 8)
+	stats["policy"] = retentionPolicyNames[this.conf.Retention]
+	stats["segmentSize"] = this.conf.SegmentSize
+	stats["bytes"] = atomic.LoadInt64(&this.backlog)
+	stats["maxBytes"] = this.conf.MaxBytes
+	stats["maxRecords"] = this.conf.MaxRecords
+	stats["maxAge"] = this.conf.MaxAge.String()
+	stats["rejected"] = atomic.LoadInt64(&this.rejected)
+	stats["dropped"] = atomic.LoadInt64(&this.dropped)
+	return stats
+}
@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_SegmentSize(t *testing.T) {
+	os.RemoveAll("test_segment")
+	conf := DefaultConfig()
+	conf.SegmentSize = 4096
+	fs := NewInstanceWithConfig("test_segment", conf)
+	bs := make([]byte, 1100)
+	for i := 0; i < 10; i++ {
+		fs.Push(bs)
+	}
+	if _, err := os.Stat("test_segment/dqueue_3.db"); err != nil {
+		t.Fail()
+	}
+	// 加大数据文件以后重新打开,写满的旧数据文件仍然可以读完
+	conf.SegmentSize = 1024 * 1024
+	fs = NewInstanceWithConfig("test_segment", conf)
+	for i := 0; i < 10; i++ {
+		if r, err := fs.Pop(); err != nil || len(r.Data) != 1100 {
+			t.Fail()
+		}
+	}
+}
+
+func Test_RetentionRejectRecords(t *testing.T) {
+	os.RemoveAll("test_retention1")
+	conf := DefaultConfig()
+	conf.MaxRecords = 3
+	fs := NewInstanceWithConfig("test_retention1", conf)
+	for i := 0; i < 3; i++ {
+		if _, err := fs.Push([]byte("abc")); err != nil {
+			t.Fail()
+		}
+	}
+	if _, err := fs.Push([]byte("abc")); err != ErrLimit {
+		t.Fail()
+	}
+	fs.Pop()
+	if _, err := fs.Push([]byte("abc")); err != nil {
+		t.Fail()
+	}
+}
+
+func Test_RetentionRejectBytes(t *testing.T) {
+	os.RemoveAll("test_retention2")
+	conf := DefaultConfig()
+	conf.MaxBytes = 100
+	fs := NewInstanceWithConfig("test_retention2", conf)
+	if _, err := fs.Push(make([]byte, 50)); err != nil {
+		t.Fail()
+	}
+	if _, err := fs.PushBatch([][]byte{make([]byte, 20), make([]byte, 20)}); err != ErrLimit {
+		t.Fail()
+	}
+}
+
+func Test_RetentionDrop(t *testing.T) {
+	os.RemoveAll("test_retention3")
+	conf := DefaultConfig()
+	conf.SegmentSize = 4096
+	conf.MaxRecords = 8
+	conf.Retention = RETENTION_DROP
+	fs := NewInstanceWithConfig("test_retention3", conf)
+	bs := make([]byte, 1100)
+	for i := 0; i < 12; i++ {
+		if _, err := fs.Push(bs); err != nil {
+			t.Fail()
+		}
+	}
+	fs.enforce()
+	// 每个数据文件4条,丢弃最早的数据文件
+	if fs.idx.GetReadNo() != 2 || fs.idx.GetLength() != 8 {
+		t.Log(fs.idx.Stats())
+		t.Fail()
+	}
+	if _, err := fs.Pop(); err != nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,193 @@
+package fs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// 消费完的数据文件的处理方式
+const (
+	// 直接删除
+	RETIRE_DELETE = iota
+	// 移动到归档目录
+	RETIRE_ARCHIVE
+	// 压缩成dqueue_N.db.gz,设置了归档目录的话放在归档目录
+	RETIRE_COMPRESS
+	// 保留在队列目录
+	RETIRE_KEEP
+)
+
+// 通知后台协程清理数据文件
+func (this *DQueueFs) triggerRetire() {
+	select {
+	case this.retireEvent <- true:
+	default:
+	}
+}
+
+func (this *DQueueFs) retireLoop() {
+	defer this.loops.Done()
+	for {
+		select {
+		case <-this.retireEvent:
+			this.retire()
+		case <-this.closed:
+			return
+		}
+	}
+}
+
+// 所有读游标中最小的db编号,比它小的数据文件都可以清理,同时返回最早的数据文件
+// 在alock、rlock和glock内读取所有游标,调用者持有slock,清理期间读游标只会前进
+// 回退读游标的Seek和从头读的CreateGroup都需要slock
+func (this *DQueueFs) retireFloor() (int, int) {
+	this.alock.Lock()
+	defer this.alock.Unlock()
+	this.rlock.Lock()
+	defer this.rlock.Unlock()
+	this.glock.Lock()
+	defer this.glock.Unlock()
+	floor := this.idx.GetReadNo()
+	for _, g := range this.groups {
+		if no := g.idx.GetReadNo(); no < floor {
+			floor = no
+		}
+	}
+	for _, d := range this.inflight {
+		if d.dbNo < floor {
+			floor = d.dbNo
+		}
+	}
+	return floor, this.firstNo()
+}
+
+// 清理所有读游标都已经读过的数据文件
+func (this *DQueueFs) retire() {
+	if this.conf.Retire == RETIRE_KEEP {
+		return
+	}
+	this.slock.Lock()
+	defer this.slock.Unlock()
+	floor, first := this.retireFloor()
+	// 保留读游标之前的SeekWindow个数据文件用来回退
+	floor -= this.conf.SeekWindow
+	// 从库还在同步的数据文件不能清理
+	for dbNo, n := range this.syncing {
+		if n > 0 && dbNo < floor {
+			floor = dbNo
+		}
+	}
+	// 清理数据文件之前保存去重快照
+	if this.dedup != nil && first < floor {
+		if err := this.saveDedup(); err != nil {
+			log.Println("retire", this.path, "save dedup", err)
+			return
+		}
+	}
+	for dbNo := first; dbNo < floor; dbNo++ {
+		this.dlock.Lock()
+		if dbs := this.dbs[dbNo]; dbs != nil {
+			dbs.Close()
+			delete(this.dbs, dbNo)
+		}
+		this.dlock.Unlock()
+		file := fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		if err := this.retireFile(file); err != nil {
+			log.Println("retire", file, err)
+			return
+		}
+		this.retired++
+	}
+}
+
+func (this *DQueueFs) retireFile(file string) error {
+	switch this.conf.Retire {
+	case RETIRE_ARCHIVE:
+		dir := filepath.Join(this.conf.ArchiveDir, this.path)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.Base(file))
+		if err := os.Rename(file, dst); err == nil {
+			return nil
+		}
+		// 跨设备不能rename,复制以后删除
+		if err := copyFile(file, dst, false); err != nil {
+			return err
+		}
+	case RETIRE_COMPRESS:
+		dir := this.path
+		if this.conf.ArchiveDir != "" {
+			dir = filepath.Join(this.conf.ArchiveDir, this.path)
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				return err
+			}
+		}
+		if err := copyFile(file, filepath.Join(dir, filepath.Base(file))+".gz", true); err != nil {
+			return err
+		}
+	}
+	return os.Remove(file)
+}
+
+// 复制文件,compress为true时使用gzip压缩
+func copyFile(src string, dst string, compress bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = out
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(out)
+		w = zw
+	}
+	_, err = io.Copy(w, in)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// 从库开始同步一个数据文件,同步期间不会被清理
+func (this *DQueueFs) acquireSync(dbNo int) bool {
+	this.slock.Lock()
+	defer this.slock.Unlock()
+	if _, err := os.Stat(fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo)); err != nil {
+		return false
+	}
+	this.syncing[dbNo]++
+	return true
+}
+
+func (this *DQueueFs) releaseSync(dbNo int) {
+	this.slock.Lock()
+	this.syncing[dbNo]--
+	if this.syncing[dbNo] <= 0 {
+		delete(this.syncing, dbNo)
+	}
+	this.slock.Unlock()
+	this.triggerRetire()
+}
@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+func pushAcrossDb(fs *DQueueFs, n int) {
+	bs := make([]byte, 1020)
+	for i := 0; i < n; i++ {
+		fs.Push(bs)
+	}
+}
+
+func Test_RetireDelete(t *testing.T) {
+	os.RemoveAll("test_retire1")
+	fs := NewInstance("test_retire1")
+	pushAcrossDb(fs, 2100)
+	for i := 0; i < 1100; i++ {
+		fs.Pop()
+	}
+	fs.retire()
+	if _, err := os.Stat("test_retire1/dqueue_1.db"); err == nil {
+		t.Fail()
+	}
+	if _, err := os.Stat("test_retire1/dqueue_2.db"); err != nil {
+		t.Fail()
+	}
+}
+
+func Test_RetireKeepForGroup(t *testing.T) {
+	os.RemoveAll("test_retire2")
+	fs := NewInstance("test_retire2")
+	fs.CreateGroup("g1", true)
+	pushAcrossDb(fs, 1100)
+	for i := 0; i < 1100; i++ {
+		fs.Pop()
+	}
+	fs.retire()
+	if _, err := os.Stat("test_retire2/dqueue_1.db"); err != nil {
+		t.Fail()
+	}
+	fs.ReadGroup("g1", 1100)
+	fs.retire()
+	if _, err := os.Stat("test_retire2/dqueue_1.db"); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_RetireKeepForSync(t *testing.T) {
+	os.RemoveAll("test_retire3")
+	fs := NewInstance("test_retire3")
+	pushAcrossDb(fs, 1100)
+	fs.acquireSync(1)
+	for i := 0; i < 1100; i++ {
+		fs.Pop()
+	}
+	fs.retire()
+	if _, err := os.Stat("test_retire3/dqueue_1.db"); err != nil {
+		t.Fail()
+	}
+	fs.releaseSync(1)
+	fs.retire()
+	if _, err := os.Stat("test_retire3/dqueue_1.db"); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_RetireCompress(t *testing.T) {
+	os.RemoveAll("test_retire4")
+	os.RemoveAll("test_archive")
+	conf := DefaultConfig()
+	conf.Retire = RETIRE_COMPRESS
+	conf.ArchiveDir = "test_archive"
+	fs := NewInstanceWithConfig("test_retire4", conf)
+	pushAcrossDb(fs, 1100)
+	for i := 0; i < 1100; i++ {
+		fs.Pop()
+	}
+	fs.retire()
+	if _, err := os.Stat("test_retire4/dqueue_1.db"); err == nil {
+		t.Fail()
+	}
+	if _, err := os.Stat("test_archive/test_retire4/dqueue_1.db.gz"); err != nil {
+		t.Fail()
+	}
+}
+
+// SeekWindow保留最近消费完的数据文件,回退到这些数据文件
+func Test_RetireSeekWindow(t *testing.T) {
+	os.RemoveAll("test_retire_seek")
+	conf := DefaultConfig()
+	conf.SeekWindow = 1
+	fs := NewInstanceWithConfig("test_retire_seek", conf)
+	pushAcrossDb(fs, 3100)
+	for i := 0; i < 2100; i++ {
+		fs.Pop()
+	}
+	fs.retire()
+	if _, err := os.Stat("test_retire_seek/dqueue_1.db"); err == nil {
+		t.Fail()
+	}
+	if _, err := os.Stat("test_retire_seek/dqueue_2.db"); err != nil {
+		t.Fail()
+	}
+	if err := fs.Seek(1, 0); err != ErrNotFound {
+		t.Fail()
+	}
+	if err := fs.Seek(2, 0); err != nil || fs.Len() <= 3100-2100 {
+		t.Fail()
+	}
+}
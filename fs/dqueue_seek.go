@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 把读游标移动到dbNo号数据文件的pos位置,可以回退到已经消费过的数据,也可以跳过没有消费的数据
+// pos需要是一条记录的开始,或者是正在写的数据文件的写位置,队列长度从新的读游标重新计算
+// 没有确认的消息和消费组不受影响
+// 默认消费完的数据文件会被删除,只能回退到还在队列目录的数据文件,已经清理的返回ErrNotFound
+// 需要回退的话使用RETIRE_KEEP或者设置SeekWindow保留最近消费完的数据文件
+func (this *DQueueFs) Seek(dbNo int, pos int) error {
+	// 移动期间数据文件不会被清理,也不会有新的写入
+	this.slock.Lock()
+	defer this.slock.Unlock()
+	this.rlock.Lock()
+	defer this.rlock.Unlock()
+	this.wlock.Lock()
+	defer this.wlock.Unlock()
+	if this.isClosed() {
+		return ErrClosed
+	}
+	if err := this.checkPos(dbNo, pos); err != nil {
+		return err
+	}
+	this.seek(dbNo, pos)
+	return nil
+}
+
+// 把读游标移动到序号不小于seq的第一条记录,没有这样的记录时移动到队列尾部
+func (this *DQueueFs) SeekSeq(seq int64) error {
+	return this.seekBy(func(e *db.Entry) int64 {
+		return e.Seq
+	}, seq)
+}
+
+// 把读游标移动到写入时间不早于t的第一条记录,没有这样的记录时移动到队列尾部
+// 写入时间是机器的时钟,时钟回拨以后结果可能不准确
+// 只查找还在队列目录的数据文件,要找的记录已经被清理的话移动到最早的一条记录
+func (this *DQueueFs) SeekTime(t time.Time) error {
+	return this.seekBy(func(e *db.Entry) int64 {
+		return e.Time
+	}, t.UnixNano())
+}
+
+// 查找key不小于target的第一条记录,key为0的旧格式记录跳过
+func (this *DQueueFs) seekBy(key func(e *db.Entry) int64, target int64) error {
+	this.slock.Lock()
+	defer this.slock.Unlock()
+	this.rlock.Lock()
+	defer this.rlock.Unlock()
+	this.wlock.Lock()
+	defer this.wlock.Unlock()
+	if this.isClosed() {
+		return ErrClosed
+	}
+	writeNo := this.idx.GetWriteNo()
+	// 记录按照写入的顺序递增,第一条记录不超过target的最后一个数据文件开始查找
+	first := this.firstNo()
+	for dbNo := first + 1; dbNo <= writeNo; dbNo++ {
+		e, _, err := this.segment(dbNo).ReadEntryAt(0)
+		if err != nil || key(e) == 0 {
+			continue
+		}
+		if key(e) > target {
+			break
+		}
+		first = dbNo
+	}
+	for dbNo := first; dbNo <= writeNo; dbNo++ {
+		dbs := this.segment(dbNo)
+		for pos := 0; ; {
+			e, next, err := dbs.ReadEntryAt(pos)
+			if err == db.ErrNew || err == db.ErrEmpty {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if k := key(e); k != 0 && k >= target {
+				this.seek(dbNo, pos)
+				return nil
+			}
+			pos = next
+		}
+	}
+	this.seek(writeNo, this.idx.GetWriteIndex())
+	return nil
+}
+
+// 检查pos是不是dbNo号数据文件中一条记录的开始
+func (this *DQueueFs) checkPos(dbNo int, pos int) error {
+	if dbNo < 1 || dbNo > this.idx.GetWriteNo() || pos < 0 {
+		return ErrNotFound
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/dqueue_%d.db", this.path, dbNo)); err != nil {
+		return ErrNotFound
+	}
+	dbs := this.segment(dbNo)
+	if pos == dbs.GetWritePos() {
+		return nil
+	}
+	if _, _, err := dbs.ReadEntryAt(pos); err != nil {
+		if err == db.ErrNew || err == db.ErrEmpty {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// 移动读游标并且重新计算队列长度,调用者需要持有slock,rlock和wlock
+func (this *DQueueFs) seek(dbNo int, pos int) {
+	log.Println("seek", this.path, "from", this.idx.GetReadNo(), this.idx.GetReadIndex(), "to", dbNo, pos)
+	// 后面的数据文件在读游标换过去的时候从头开始读
+	this.dlock.Lock()
+	for no, dbs := range this.dbs {
+		if no > dbNo {
+			dbs.SetReadPos(0)
+		}
+	}
+	this.dlock.Unlock()
+	this.segment(dbNo).SetReadPos(pos)
+	this.idx.Begin()
+	this.idx.SetReadNo(dbNo)
+	this.idx.SetReadIndex(pos)
+	this.idx.SetLength(this.countFrom(dbNo, pos))
+	this.idx.Commit()
+	switch this.conf.Sync {
+	case SYNC_ALWAYS:
+		this.idx.Sync()
+	case SYNC_EVERYSEC:
+		atomic.StoreInt32(&this.dirty, 1)
+	}
+	this.loadBacklog()
+	this.triggerRetention()
+	// 回退以后阻塞的消费者可以读到数据
+	this.notifyPush()
+}
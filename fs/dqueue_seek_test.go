@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Seek(t *testing.T) {
+	os.RemoveAll("test_seek")
+	fs := NewInstanceWithConfig("test_seek", &Config{SegmentSize: 4096, Retire: RETIRE_KEEP})
+	payload := strings.Repeat("x", 1100)
+	for i := 0; i < 10; i++ {
+		fs.Push([]byte(fmt.Sprintf("%d%s", i, payload)))
+	}
+	records, _ := fs.Peek(10)
+	for i := 0; i < 8; i++ {
+		fs.Pop()
+	}
+	// 回退到第3条数据
+	if err := fs.Seek(records[3].DbNo, records[3].Pos); err != nil {
+		t.Fail()
+	}
+	if fs.Len() != 7 {
+		t.Fail()
+	}
+	if r, _ := fs.Pop(); r.Data[0] != '3' {
+		t.Fail()
+	}
+	// 不是记录开始的位置
+	if err := fs.Seek(records[3].DbNo, records[3].Pos+1); err == nil {
+		t.Fail()
+	}
+	if err := fs.Seek(100, 0); err != ErrNotFound {
+		t.Fail()
+	}
+
+	// 按照序号移动
+	if err := fs.SeekSeq(records[5].Seq); err != nil || fs.Len() != 5 {
+		t.Fail()
+	}
+	if r, _ := fs.Pop(); r.Data[0] != '5' {
+		t.Fail()
+	}
+	if records[9].Seq != records[0].Seq+9 {
+		t.Fail()
+	}
+	// 超过最后一条数据移动到尾部
+	if err := fs.SeekSeq(records[9].Seq + 1); err != nil || fs.Len() != 0 {
+		t.Fail()
+	}
+
+	// 按照时间移动
+	if err := fs.SeekTime(time.Unix(0, records[0].Time)); err != nil || fs.Len() != 10 {
+		t.Fail()
+	}
+	time.Sleep(10 * time.Millisecond)
+	now := time.Now()
+	fs.Push([]byte("new"))
+	if err := fs.SeekTime(now); err != nil || fs.Len() != 1 {
+		t.Fail()
+	}
+	if r, _ := fs.Pop(); string(r.Data) != "new" {
+		t.Fail()
+	}
+
+	// 重启以后序号继续增加
+	fs.Close()
+	fs = NewInstanceWithConfig("test_seek", &Config{SegmentSize: 4096, Retire: RETIRE_KEEP})
+	fs.Push([]byte("after"))
+	records, _ = fs.Peek(1)
+	if len(records) != 1 || records[0].Seq != 12 {
+		t.Fail()
+	}
+}
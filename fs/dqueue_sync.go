@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 刷磁盘的策略
+const (
+	// 每次写入都fsync以后再返回
+	SYNC_ALWAYS = iota
+	// 后台每秒fsync一次
+	SYNC_EVERYSEC
+	// 不主动fsync,由操作系统决定
+	SYNC_NO
+)
+
+var syncPolicyNames = map[int]string{
+	SYNC_ALWAYS:   "always",
+	SYNC_EVERYSEC: "everysec",
+	SYNC_NO:       "no",
+}
+
+// 写入和fsync的次数和耗时
+type syncStats struct {
+	lock       sync.Mutex
+	pushes     int64
+	pushTime   time.Duration
+	fsyncs     int64
+	fsyncTime  time.Duration
+	fsyncMax   time.Duration
+	fsyncError int64
+}
+
+func (this *syncStats) addPush(d time.Duration) {
+	this.lock.Lock()
+	this.pushes++
+	this.pushTime += d
+	this.lock.Unlock()
+}
+
+func (this *syncStats) addFsync(d time.Duration, err error) {
+	this.lock.Lock()
+	this.fsyncs++
+	this.fsyncTime += d
+	if d > this.fsyncMax {
+		this.fsyncMax = d
+	}
+	if err != nil {
+		this.fsyncError++
+	}
+	this.lock.Unlock()
+}
+
+func (this *syncStats) stats(policy int) map[string]interface{} {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	stats := make(map[string]interface{}, 8)
+	stats["policy"] = syncPolicyNames[policy]
+	stats["pushes"] = this.pushes
+	stats["fsyncs"] = this.fsyncs
+	stats["fsyncErrors"] = this.fsyncError
+	stats["pushAvgUs"] = int64(0)
+	stats["fsyncAvgUs"] = int64(0)
+	stats["fsyncMaxUs"] = int64(this.fsyncMax / time.Microsecond)
+	if this.pushes > 0 {
+		stats["pushAvgUs"] = int64(this.pushTime/time.Microsecond) / this.pushes
+	}
+	if this.fsyncs > 0 {
+		stats["fsyncAvgUs"] = int64(this.fsyncTime/time.Microsecond) / this.fsyncs
+	}
+	return stats
+}
+
+// 数据文件和索引文件刷到磁盘
+func (this *DQueueFs) fsync() error {
+	begin := time.Now()
+	err := this.segment(this.idx.GetWriteNo()).Sync()
+	if e := this.idx.Sync(); err == nil {
+		err = e
+	}
+	this.syncStats.addFsync(time.Since(begin), err)
+	return err
+}
+
+// 根据策略刷磁盘或者标记为需要刷磁盘
+func (this *DQueueFs) syncWrite() error {
+	switch this.conf.Sync {
+	case SYNC_ALWAYS:
+		return this.fsync()
+	case SYNC_EVERYSEC:
+		atomic.StoreInt32(&this.dirty, 1)
+	}
+	return nil
+}
+
+// SYNC_EVERYSEC时每秒刷一次磁盘
+func (this *DQueueFs) syncLoop() {
+	defer this.loops.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-this.closed:
+			return
+		}
+		if atomic.SwapInt32(&this.dirty, 0) == 0 {
+			continue
+		}
+		if err := this.fsync(); err != nil {
+			log.Println("fsync", this.path, err)
+		}
+		this.alock.Lock()
+		this.ackFp.Sync()
+		this.alock.Unlock()
+	}
+}
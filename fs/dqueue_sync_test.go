@@ -0,0 +1,45 @@
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_SyncAlways(t *testing.T) {
+	os.RemoveAll("test_sync")
+	conf := DefaultConfig()
+	conf.Sync = SYNC_ALWAYS
+	fs := NewInstanceWithConfig("test_sync", conf)
+	for i := 0; i < 10; i++ {
+		if _, err := fs.Push([]byte("abc")); err != nil {
+			t.Fail()
+		}
+	}
+	stats := fs.Stats()["sync"].(map[string]interface{})
+	if stats["policy"] != "always" || stats["fsyncs"].(int64) != 10 || stats["pushes"].(int64) != 10 {
+		t.Log(stats)
+		t.Fail()
+	}
+}
+
+func Test_SyncNo(t *testing.T) {
+	os.RemoveAll("test_sync")
+	fs := NewInstance("test_sync")
+	fs.Push([]byte("abc"))
+	stats := fs.Stats()["sync"].(map[string]interface{})
+	if stats["policy"] != "no" || stats["fsyncs"].(int64) != 0 || stats["pushes"].(int64) != 1 {
+		t.Log(stats)
+		t.Fail()
+	}
+}
+
+func Benchmark_PushSyncAlways(b *testing.B) {
+	os.RemoveAll("test_sync")
+	conf := DefaultConfig()
+	conf.Sync = SYNC_ALWAYS
+	fs := NewInstanceWithConfig("test_sync", conf)
+	bs := make([]byte, 1024)
+	for i := 0; i < b.N; i++ {
+		fs.Push(bs)
+	}
+}
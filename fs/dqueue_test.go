@@ -1,10 +1,15 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
+	"github.com/wudikua/dqueue/db"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
-	// "time"
+	"time"
 )
 
 func Test_NewInstance(t *testing.T) {
@@ -34,12 +39,12 @@ func Test_PushAndPop(t *testing.T) {
 	if _, err := fs.Push([]byte("abc")); err != nil {
 		t.Fail()
 	}
-	_, bs, err := fs.Pop()
+	r, err := fs.Pop()
 	if err != nil {
 		t.Fail()
 	}
 	for k, v := range []byte("abc") {
-		if v != bs[k] {
+		if v != r.Data[k] {
 			t.Fail()
 		}
 	}
@@ -55,12 +60,12 @@ func Test_PopEmpty(t *testing.T) {
 	if _, err := fs.Push([]byte("abc")); err != nil {
 		t.Fail()
 	}
-	_, bs, err := fs.Pop()
-	if string(bs) != "abc" {
-		t.Log(string(bs))
+	r, err := fs.Pop()
+	if string(r.Data) != "abc" {
+		t.Log(string(r.Data))
 		t.Fail()
 	}
-	_, _, err = fs.Pop()
+	_, err = fs.Pop()
 	if err == nil {
 		t.Fail()
 	}
@@ -77,11 +82,11 @@ func Test_PushSlice(t *testing.T) {
 		if _, err := fs.Push([]byte("abc")); err != nil {
 			t.Fail()
 		}
-		_, bs, err := fs.Pop()
+		r, err := fs.Pop()
 		if err != nil {
 			t.Fail()
 		}
-		t.Log(string(bs))
+		t.Log(string(r.Data))
 	}
 }
 
@@ -98,14 +103,14 @@ func Benchmark_PushAndPop(b *testing.B) {
 			b.Fail()
 		}
 
-		_, bs, err := fs.Pop()
+		r, err := fs.Pop()
 		if err != nil {
 			b.Log(err)
 			b.Fail()
 		}
 		for k, v := range []byte(fmt.Sprintf("%d", i)) {
-			if v != bs[k] {
-				b.Log(string(bs))
+			if v != r.Data[k] {
+				b.Log(string(r.Data))
 				b.Fail()
 			}
 		}
@@ -130,3 +135,196 @@ func Benchmark_Push(b *testing.B) {
 		}
 	}
 }
+
+func Test_PushBatch(t *testing.T) {
+	os.RemoveAll("test_batch")
+	fs := NewInstance("test_batch")
+	length, err := fs.PushBatch([][]byte{[]byte("abc"), []byte("def")})
+	if err != nil || length != 2 {
+		t.Fail()
+	}
+	for _, v := range []string{"abc", "def"} {
+		r, err := fs.Pop()
+		if err != nil || string(r.Data) != v {
+			t.Fail()
+		}
+	}
+}
+
+func Test_PushBatchSameDb(t *testing.T) {
+	os.RemoveAll("test_batch")
+	fs := NewInstance("test_batch")
+	bs := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		fs.Push(bs)
+	}
+	// 超过文件大小限制的一批数据也写在同一个db
+	batch := make([][]byte, 100)
+	for i := range batch {
+		batch[i] = bs
+	}
+	if _, err := fs.PushBatch(batch); err != nil {
+		t.Fail()
+	}
+	if fs.idx.GetWriteNo() != 1 || fs.idx.GetLength() != 1100 {
+		t.Fail()
+	}
+	fs.Push(bs)
+	if fs.idx.GetWriteNo() != 2 {
+		t.Fail()
+	}
+}
+
+func Test_PushConcurrent(t *testing.T) {
+	os.RemoveAll("test_batch")
+	conf := DefaultConfig()
+	conf.Sync = SYNC_ALWAYS
+	fs := NewInstanceWithConfig("test_batch", conf)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := fs.Push([]byte("abc")); err != nil {
+					t.Fail()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if fs.idx.GetLength() != 1000 {
+		t.Fail()
+	}
+	n := 0
+	for {
+		if _, err := fs.Pop(); err != nil {
+			break
+		}
+		n++
+	}
+	if n != 1000 {
+		t.Fail()
+	}
+}
+
+func Benchmark_PushParallel(b *testing.B) {
+	os.RemoveAll("test_batch")
+	conf := DefaultConfig()
+	conf.Sync = SYNC_ALWAYS
+	fs := NewInstanceWithConfig("test_batch", conf)
+	bs := make([]byte, 1024)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			fs.Push(bs)
+		}
+	})
+}
+
+func Test_PopRecord(t *testing.T) {
+	os.RemoveAll("test_record")
+	os.RemoveAll("test_record2")
+	fs := NewInstance("test_record")
+	begin := time.Now().UnixNano()
+	fs.Push([]byte("abc"))
+	fs.PushWithHeaders([]byte("def"), map[string]string{"type": "order"})
+	r, err := fs.Pop()
+	if err != nil || string(r.Data) != "abc" || r.Seq != 1 || r.Time < begin || r.Headers != nil || r.Id() != "1-0" {
+		t.Fail()
+	}
+	// 移动以后消息头不变
+	dst := NewInstance("test_record2")
+	fs.MoveTo(dst)
+	r, err = dst.Pop()
+	if err != nil || string(r.Data) != "def" || r.Headers["type"] != "order" {
+		t.Fail()
+	}
+	if _, err := fs.Pop(); err != db.ErrEmpty {
+		t.Fail()
+	}
+}
+
+// 关闭压缩以后仍然可以读出压缩过的数据
+func Test_PushCompressed(t *testing.T) {
+	os.RemoveAll("test_compress")
+	conf := DefaultConfig()
+	conf.Compression = db.COMPRESS_FLATE
+	fs := NewInstanceWithConfig("test_compress", conf)
+	data := make([]byte, 1000)
+	fs.PushWithHeaders(data, map[string]string{"type": "zero"})
+	fs.Push([]byte("abc"))
+	fs.Close()
+
+	fs = NewInstance("test_compress")
+	r, err := fs.Pop()
+	if err != nil || len(r.Data) != 1000 || r.Headers["type"] != "zero" {
+		t.Fail()
+	}
+	r, err = fs.Pop()
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+	fs.Close()
+}
+
+func Test_PushEncrypted(t *testing.T) {
+	os.RemoveAll("test_crypt")
+	os.Mkdir("test_crypt", 0777)
+	ioutil.WriteFile("test_crypt/keys", []byte("# rotated\nold:000102030405060708090a0b0c0d0e0f\n"), 0600)
+	conf := DefaultConfig()
+	conf.KeyFile = "test_crypt/keys"
+	fs := NewInstanceWithConfig("test_crypt", conf)
+	fs.Push([]byte("secret"))
+	fs.Close()
+	bs, _ := ioutil.ReadFile("test_crypt/dqueue_1.db")
+	if len(bs) == 0 || strings.Contains(string(bs), "secret") {
+		t.Fail()
+	}
+
+	// 换成新的密钥,旧的密钥保留用来解密
+	ioutil.WriteFile("test_crypt/keys", []byte("old:000102030405060708090a0b0c0d0e0f\nnew:0f0e0d0c0b0a09080706050403020100\n"), 0600)
+	fs = NewInstanceWithConfig("test_crypt", conf)
+	fs.Push([]byte("abc"))
+	r, err := fs.Pop()
+	if err != nil || string(r.Data) != "secret" {
+		t.Fail()
+	}
+	r, err = fs.Pop()
+	if err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+	fs.Close()
+
+	conf.KeyFile = "test_crypt/missing"
+	if NewInstanceWithConfig("test_crypt", conf) != nil {
+		t.Fail()
+	}
+}
+
+// 同一组写入中一个请求的消息头超过上限,只有这个请求失败
+func Test_CommitBadRequest(t *testing.T) {
+	os.RemoveAll("test_commit")
+	fs := NewInstance("test_commit")
+	headers := make(map[string]string)
+	for i := 0; i < db.MAX_HEADERS+1; i++ {
+		headers[fmt.Sprint(i)] = "v"
+	}
+	good := &pushReq{bss: [][]byte{[]byte("abc")}}
+	bad := &pushReq{bss: [][]byte{[]byte("def")}, headers: headers}
+	last := &pushReq{bss: [][]byte{[]byte("ghi")}}
+	fs.wlock.Lock()
+	fs.commit([]*pushReq{good, bad, last})
+	fs.wlock.Unlock()
+	if good.err != nil || last.err != nil || !errors.Is(bad.err, db.ErrTooLarge) {
+		t.Fail()
+	}
+	if fs.Len() != 2 {
+		t.Fail()
+	}
+	if r, _ := fs.Pop(); r == nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+	if r, _ := fs.Pop(); r == nil || string(r.Data) != "ghi" {
+		t.Fail()
+	}
+}
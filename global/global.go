@@ -9,4 +9,8 @@ const (
 	OP_CHANGE_READNO
 	OP_CHANGE_WRITENO
 	OP_HEARTBEAT
+	// 后面是通道编号(4)和这个通道的操作
+	OP_LANE
+	// 后面是去重快照
+	OP_DEDUP
 )
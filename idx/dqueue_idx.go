@@ -3,23 +3,51 @@ package idx
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"io/ioutil"
 	"log"
 	"os"
+	"sync"
 )
 
 // dqueue 6个字节
 var MAGIC = []byte{100, 113, 117, 101, 117, 101}
 var MAGIC_LEN = 6
 
+// 索引文件格式: magic(6) version(1) slot0(60) slot1(60)
+// 每个slot是一份完整的索引: generation(8) readNo(8) readIndex(8) writeNo(8) writeIndex(8) length(8) seq(8) crc(4)
+// seq是下一条写入的数据的序号,从1开始
+// 每次更新写generation+1到另一个slot,启动时取校验通过并且generation最大的slot
+// 写slot的过程中崩溃只会损坏正在写的slot,另一个slot保存的是上一次完整的索引
+const (
+	INDEX_VERSION = 1
+	HEADER_LEN    = 7
+	SLOT_LEN      = 60
+	SLOT_COUNT    = 2
+	INDEX_LEN     = HEADER_LEN + SLOT_LEN*SLOT_COUNT
+)
+
+// 没有版本号的旧格式 magic(6) readNo(4) readIndex(4) writeNo(4) writeIndex(4) length(4),length可能没有
+const LEGACY_INDEX_LEN = 26
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type DQueueIndex struct {
 	readNo     int
 	readIndex  int
 	writeNo    int
 	writeIndex int
 	length     int
+	seq        int64
 	file       string
 	fp         *os.File
-	w, r       int
+	generation uint64
+	// 保护索引的字段和文件
+	lock sync.Mutex
+	// Begin到Commit之间持有,同一时间只有一组修改
+	tlock sync.Mutex
+	// 为true的时候只修改内存,Commit的时候一起写入
+	batch bool
 }
 
 func NewInstance(file string) *DQueueIndex {
@@ -27,65 +55,136 @@ func NewInstance(file string) *DQueueIndex {
 	// 判断索引文件是否存在
 	if _, err := os.Stat(file); err == nil {
 		// 存在
-		fp, _ := os.OpenFile(file, os.O_RDWR, 0666)
+		fp, err := os.OpenFile(file, os.O_RDWR, 0666)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
 		instance = &DQueueIndex{
 			file: file,
 			fp:   fp,
-			w:    0,
-			r:    0,
 		}
-
-		instance.initIndexInfoFromFile()
-
+		if err := instance.initIndexInfoFromFile(); err != nil {
+			log.Println(file, err)
+			fp.Close()
+			return nil
+		}
 	} else {
 		// 不存在 创建索引文件
-		fp, _ := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0660)
+		fp, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0660)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
 		instance = &DQueueIndex{
 			readNo:     1,
 			readIndex:  0,
 			writeNo:    1,
 			writeIndex: 0,
 			length:     0,
+			seq:        1,
 			file:       file,
 			fp:         fp,
-			w:          0,
-			r:          0,
 		}
-		// 写6个字节是dqueue
-		instance.writeMagic()
-		// 写4个字节读到第几个库了
-		instance.writeInt32(instance.readNo)
-		// // 写4个字节读到数据库的位置
-		instance.writeInt32(instance.readIndex)
-		// // 写4个字节写到第几个库了
-		instance.writeInt32(instance.writeNo)
-		// // 写4个字节写到数据的库位置
-		instance.writeInt32(instance.writeIndex)
+		// 写6个字节是dqueue和1个字节的版本号
+		if _, err := instance.writeMagic(); err != nil {
+			log.Println(err)
+			fp.Close()
+			return nil
+		}
+		// 两个slot都写上初始的索引
+		instance.save()
+		instance.save()
 	}
 
 	return instance
 }
 
 func (this *DQueueIndex) initIndexInfoFromFile() error {
-	this.w = 0
-	this.r = 0
+	fi, err := this.fp.Stat()
+	if err != nil {
+		return err
+	}
 	if _, err := this.readMagic(); err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	bs := make([]byte, fi.Size())
+	if _, err := this.fp.ReadAt(bs, 0); err != nil {
+		return err
+	}
+	legacy, err := this.load(bs)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return this.upgrade()
+	}
+	return nil
+}
+
+// 解析索引文件的内容,旧格式返回true
+func (this *DQueueIndex) load(bs []byte) (bool, error) {
+	if len(bs) < MAGIC_LEN || string(bs[:MAGIC_LEN]) != string(MAGIC) {
+		return false, errors.New("Not a Index File")
+	}
+	switch {
+	case len(bs) <= LEGACY_INDEX_LEN:
+		return true, this.loadLegacy(bs)
+	case len(bs) < INDEX_LEN:
+		return false, errors.New("Index File Truncated")
+	}
+	if bs[MAGIC_LEN] != INDEX_VERSION {
+		return false, errors.New("Unsupported Index Version")
+	}
+	return false, this.loadSlots(bs)
+}
+
+// 只读的打开索引文件,不会创建、升级或者修改文件,也不占用文件句柄
+// 返回的索引只能读取,用来查看其他进程或者其他队列正在使用的索引,失败返回nil
+func ReadOnly(file string) *DQueueIndex {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	instance := &DQueueIndex{file: file}
+	if _, err := instance.load(bs); err != nil {
+		log.Println(file, err)
 		return nil
 	}
+	return instance
+}
 
-	this.readNo, _ = this.readInt32()
-	this.readIndex, _ = this.readInt32()
-	this.writeNo, _ = this.readInt32()
-	this.writeIndex, _ = this.readInt32()
-	this.length, _ = this.readInt32()
+// 取校验通过并且最新的slot
+func (this *DQueueIndex) loadSlots(bs []byte) error {
+	found := false
+	for i := 0; i < SLOT_COUNT; i++ {
+		slot := bs[HEADER_LEN+i*SLOT_LEN : HEADER_LEN+(i+1)*SLOT_LEN]
+		if crc32.Checksum(slot[:SLOT_LEN-4], castagnoli) != binary.BigEndian.Uint32(slot[SLOT_LEN-4:]) {
+			continue
+		}
+		generation := binary.BigEndian.Uint64(slot)
+		if found && generation <= this.generation {
+			continue
+		}
+		found = true
+		this.generation = generation
+		this.readNo = int(binary.BigEndian.Uint64(slot[8:]))
+		this.readIndex = int(binary.BigEndian.Uint64(slot[16:]))
+		this.writeNo = int(binary.BigEndian.Uint64(slot[24:]))
+		this.writeIndex = int(binary.BigEndian.Uint64(slot[32:]))
+		this.length = int(binary.BigEndian.Uint64(slot[40:]))
+		this.seq = int64(binary.BigEndian.Uint64(slot[48:]))
+	}
+	if !found {
+		return errors.New("Index File Corrupted")
+	}
 	return nil
 }
 
 func (this *DQueueIndex) readMagic() (int, error) {
 	b := make([]byte, MAGIC_LEN)
-	n, err := this.fp.ReadAt(b, int64(this.r))
-	this.r += n
+	n, err := this.fp.ReadAt(b, 0)
 	if err != nil {
 		return n, err
 	}
@@ -96,104 +195,209 @@ func (this *DQueueIndex) readMagic() (int, error) {
 }
 
 func (this *DQueueIndex) writeMagic() (int, error) {
-	n, err := this.fp.WriteAt(MAGIC, int64(this.w))
-	this.w += n
+	return this.fp.WriteAt(append(MAGIC[:MAGIC_LEN:MAGIC_LEN], INDEX_VERSION), 0)
+}
 
-	return n, err
+// 载入固定位置保存每个字段的旧格式
+func (this *DQueueIndex) loadLegacy(bs []byte) error {
+	if len(bs) < 22 {
+		return errors.New("Index File Truncated")
+	}
+	this.readNo = int(binary.BigEndian.Uint32(bs[6:]))
+	this.readIndex = int(binary.BigEndian.Uint32(bs[10:]))
+	this.writeNo = int(binary.BigEndian.Uint32(bs[14:]))
+	this.writeIndex = int(binary.BigEndian.Uint32(bs[18:]))
+	if len(bs) >= LEGACY_INDEX_LEN {
+		this.length = int(binary.BigEndian.Uint32(bs[22:]))
+	}
+	this.seq = 1
+	return nil
 }
 
-func (this *DQueueIndex) readInt32() (int, error) {
-	bs := make([]byte, 4)
-	n, err := this.fp.ReadAt(bs, int64(this.r))
+// 把载入的旧格式索引写成当前格式
+// 先写临时文件并刷到磁盘,再重命名覆盖旧文件,中间崩溃的话旧文件还是完整的
+func (this *DQueueIndex) upgrade() error {
+	tmp := this.file + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0660)
 	if err != nil {
-		return n, err
+		return err
+	}
+	old := this.fp
+	this.fp = fp
+	this.generation = 0
+	_, err = this.writeMagic()
+	if err == nil {
+		_, err = this.save()
+	}
+	if err == nil {
+		_, err = this.save()
+	}
+	if err == nil {
+		err = fp.Sync()
 	}
-	this.r += n
-	return int(binary.BigEndian.Uint32(bs)), nil
+	if err == nil {
+		err = os.Rename(tmp, this.file)
+	}
+	if err != nil {
+		this.fp = old
+		fp.Close()
+		os.Remove(tmp)
+		return err
+	}
+	old.Close()
+	log.Println("upgrade index", this.file, "to version", INDEX_VERSION)
+	return nil
 }
 
-func (this *DQueueIndex) writeInt32(i int) (int, error) {
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(i))
-	n, err := this.fp.WriteAt(bs, int64(this.w))
-	this.w += n
-	return n, err
+// 写入一个新的slot,generation加1,写到较旧的那个slot,调用者需要持有lock
+func (this *DQueueIndex) save() (int, error) {
+	this.generation++
+	bs := make([]byte, SLOT_LEN)
+	binary.BigEndian.PutUint64(bs, this.generation)
+	binary.BigEndian.PutUint64(bs[8:], uint64(this.readNo))
+	binary.BigEndian.PutUint64(bs[16:], uint64(this.readIndex))
+	binary.BigEndian.PutUint64(bs[24:], uint64(this.writeNo))
+	binary.BigEndian.PutUint64(bs[32:], uint64(this.writeIndex))
+	binary.BigEndian.PutUint64(bs[40:], uint64(this.length))
+	binary.BigEndian.PutUint64(bs[48:], uint64(this.seq))
+	binary.BigEndian.PutUint32(bs[56:], crc32.Checksum(bs[:56], castagnoli))
+	offset := HEADER_LEN + int(this.generation%SLOT_COUNT)*SLOT_LEN
+	return this.fp.WriteAt(bs, int64(offset))
+}
+
+// 在lock内修改字段以后写入,Begin和Commit之间只修改内存
+func (this *DQueueIndex) update(fn func()) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	fn()
+	if this.batch {
+		return 0, nil
+	}
+	return this.save()
+}
+
+// 开始一组修改,Commit的时候一次写入,多个字段的修改要么都生效要么都不生效
+// 同一时间只有一组修改,其他goroutine的Begin等待Commit,不能嵌套调用
+// 其他goroutine在这期间的单个修改也在Commit的时候写入
+func (this *DQueueIndex) Begin() {
+	this.tlock.Lock()
+	this.lock.Lock()
+	this.batch = true
+	this.lock.Unlock()
+}
+
+// 提交Begin以后的修改
+func (this *DQueueIndex) Commit() (int, error) {
+	defer this.tlock.Unlock()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.batch = false
+	return this.save()
 }
 
 func (this *DQueueIndex) SetReadNo(i int) (int, error) {
-	this.readNo = i
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(i))
-	return this.fp.WriteAt(bs, 6)
+	return this.update(func() { this.readNo = i })
 }
 
 func (this *DQueueIndex) GetReadNo() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	return this.readNo
 }
 
 func (this *DQueueIndex) SetReadIndex(i int) (int, error) {
-	this.readIndex = i
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(i))
-	return this.fp.WriteAt(bs, 10)
+	return this.update(func() { this.readIndex = i })
 }
 
 func (this *DQueueIndex) GetReadIndex() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	return this.readIndex
 }
 
 func (this *DQueueIndex) SetWriteNo(i int) (int, error) {
-	this.writeNo = i
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(i))
-	return this.fp.WriteAt(bs, 14)
+	return this.update(func() { this.writeNo = i })
 }
 
 func (this *DQueueIndex) GetWriteNo() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	return this.writeNo
 }
 
 func (this *DQueueIndex) SetWriteIndex(i int) (int, error) {
-	this.writeIndex = i
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(i))
-	return this.fp.WriteAt(bs, 18)
+	return this.update(func() { this.writeIndex = i })
 }
 
 func (this *DQueueIndex) GetWriteIndex() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	return this.writeIndex
 }
 
 func (this *DQueueIndex) IncLength() (int, error) {
-	this.length = this.length + 1
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(this.length))
-	return this.fp.WriteAt(bs, 22)
+	return this.AddLength(1)
 }
 
 func (this *DQueueIndex) DecLength() (int, error) {
-	this.length = this.length - 1
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(this.length))
-	return this.fp.WriteAt(bs, 22)
+	return this.AddLength(-1)
+}
+
+func (this *DQueueIndex) AddLength(n int) (int, error) {
+	return this.update(func() { this.length += n })
 }
 
 func (this *DQueueIndex) SetLength(length int) (int, error) {
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, uint32(length))
-	return this.fp.WriteAt(bs, 22)
+	return this.update(func() { this.length = length })
 }
 
 func (this *DQueueIndex) GetLength() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	return this.length
 }
 
+// 设置下一条写入的数据的序号
+func (this *DQueueIndex) SetSeq(seq int64) (int, error) {
+	return this.update(func() { this.seq = seq })
+}
+
+func (this *DQueueIndex) AddSeq(n int) (int, error) {
+	return this.update(func() { this.seq += int64(n) })
+}
+
+func (this *DQueueIndex) GetSeq() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.seq
+}
+
+// 索引刷到磁盘
+func (this *DQueueIndex) Sync() error {
+	return this.fp.Sync()
+}
+
+// 索引刷到磁盘并关闭文件
+func (this *DQueueIndex) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	err := this.fp.Sync()
+	if e := this.fp.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
 func (this *DQueueIndex) Stats() map[string]interface{} {
-	stats := make(map[string]interface{}, 4)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	stats := make(map[string]interface{}, 8)
 	stats["readNo"] = this.readNo
 	stats["readIndex"] = this.readIndex
 	stats["writeNo"] = this.writeNo
 	stats["writeIndex"] = this.writeIndex
 	stats["length"] = this.length
+	stats["seq"] = this.seq
+	stats["generation"] = this.generation
 	return stats
 }
@@ -1,7 +1,9 @@
 package idx
 
 import (
+	"encoding/binary"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -100,6 +102,130 @@ func Test_setWriteIndex(t *testing.T) {
 	}
 }
 
+func Test_upgradeLegacy(t *testing.T) {
+	os.Remove("dqueue.idx")
+	// 旧格式的索引文件
+	bs := make([]byte, LEGACY_INDEX_LEN)
+	copy(bs, MAGIC)
+	binary.BigEndian.PutUint32(bs[6:], 2)
+	binary.BigEndian.PutUint32(bs[10:], 100)
+	binary.BigEndian.PutUint32(bs[14:], 3)
+	binary.BigEndian.PutUint32(bs[18:], 200)
+	binary.BigEndian.PutUint32(bs[22:], 10)
+	f, _ := os.Create("dqueue.idx")
+	f.Write(bs)
+	f.Close()
+
+	idx := NewInstance("dqueue.idx")
+	if idx == nil {
+		t.FailNow()
+	}
+	if idx.readNo != 2 || idx.readIndex != 100 || idx.writeNo != 3 || idx.writeIndex != 200 || idx.length != 10 {
+		t.Fail()
+	}
+	if fi, _ := os.Stat("dqueue.idx"); fi.Size() != INDEX_LEN {
+		t.Fail()
+	}
+	idx = NewInstance("dqueue.idx")
+	if idx == nil || idx.writeIndex != 200 || idx.length != 10 {
+		t.Fail()
+	}
+}
+
+func Test_length64(t *testing.T) {
+	os.Remove("dqueue.idx")
+	idx := NewInstance("dqueue.idx")
+	if idx == nil {
+		t.FailNow()
+	}
+	idx.SetLength(1 << 33)
+	idx.AddLength(1)
+	idx = NewInstance("dqueue.idx")
+	if idx == nil || idx.length != 1<<33+1 {
+		t.Fail()
+	}
+}
+
+func Test_tornSlot(t *testing.T) {
+	os.Remove("dqueue.idx")
+	idx := NewInstance("dqueue.idx")
+	if idx == nil {
+		t.FailNow()
+	}
+	idx.SetWriteIndex(100)
+	idx.SetWriteIndex(200)
+	// 最新的slot写坏了,回退到上一次的索引
+	offset := HEADER_LEN + int(idx.generation%SLOT_COUNT)*SLOT_LEN
+	idx.fp.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(offset+32))
+	idx = NewInstance("dqueue.idx")
+	if idx == nil || idx.writeIndex != 100 {
+		t.Fail()
+	}
+}
+
+func Test_beginCommit(t *testing.T) {
+	os.Remove("dqueue.idx")
+	idx := NewInstance("dqueue.idx")
+	if idx == nil {
+		t.FailNow()
+	}
+	generation := idx.generation
+	idx.Begin()
+	idx.SetWriteNo(2)
+	idx.SetWriteIndex(0)
+	idx.AddLength(5)
+	if idx.generation != generation {
+		t.Fail()
+	}
+	idx.Commit()
+	if idx.generation != generation+1 {
+		t.Fail()
+	}
+	idx = NewInstance("dqueue.idx")
+	if idx == nil || idx.writeNo != 2 || idx.length != 5 {
+		t.Fail()
+	}
+}
+
+// 写和读的goroutine同时修改索引,每组修改一起写入
+func Test_beginCommitConcurrent(t *testing.T) {
+	os.Remove("dqueue.idx")
+	idx := NewInstance("dqueue.idx")
+	if idx == nil {
+		t.FailNow()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				idx.Begin()
+				idx.AddLength(1)
+				idx.AddSeq(1)
+				idx.Commit()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				idx.SetReadIndex(j)
+				idx.GetLength()
+				idx.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+	if idx.GetLength() != 800 || idx.GetSeq() != 801 {
+		t.Fail()
+	}
+	idx.Close()
+	idx = NewInstance("dqueue.idx")
+	if idx == nil || idx.GetLength() != 800 || idx.GetSeq() != 801 {
+		t.Fail()
+	}
+}
+
 func Benchmark_NewInstance(b *testing.B) {
 	os.Remove("dqueue.idx")
 	for i := 0; i < b.N; i++ {
@@ -157,3 +283,44 @@ func Benchmark_initIndexInfoFromFile(b *testing.B) {
 		idx.initIndexInfoFromFile()
 	}
 }
+
+func Test_seq(t *testing.T) {
+	os.Remove("dqueue.idx")
+	idx := NewInstance("dqueue.idx")
+	if idx == nil || idx.GetSeq() != 1 {
+		t.FailNow()
+	}
+	idx.AddSeq(10)
+	idx = NewInstance("dqueue.idx")
+	if idx == nil || idx.GetSeq() != 11 {
+		t.Fail()
+	}
+}
+
+// 只读的打开不会升级旧格式的索引文件
+func Test_readOnly(t *testing.T) {
+	os.Remove("dqueue.idx")
+	if ReadOnly("dqueue.idx") != nil {
+		t.Fail()
+	}
+	bs := make([]byte, LEGACY_INDEX_LEN)
+	copy(bs, MAGIC)
+	binary.BigEndian.PutUint32(bs[6:], 2)
+	binary.BigEndian.PutUint32(bs[10:], 100)
+	binary.BigEndian.PutUint32(bs[14:], 3)
+	binary.BigEndian.PutUint32(bs[18:], 200)
+	f, _ := os.Create("dqueue.idx")
+	f.Write(bs)
+	f.Close()
+
+	idx := ReadOnly("dqueue.idx")
+	if idx == nil || idx.GetWriteNo() != 3 || idx.GetWriteIndex() != 200 {
+		t.Fail()
+	}
+	if fi, _ := os.Stat("dqueue.idx"); fi.Size() != LEGACY_INDEX_LEN {
+		t.Fail()
+	}
+	if _, err := os.Stat("dqueue.idx.tmp"); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,119 @@
+package manager
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// 队列名的最大长度
+	MAX_KEY_LEN = 1024
+	// 编码以后每一级目录名的最大长度
+	MAX_NAME_LEN = 255
+	// 队列名中分隔命名空间的字符,tenant:queue对应目录@tenant/queue
+	NAMESPACE_SEP = ":"
+	// 命名空间目录的前缀,编码以后的队列名不会以它开头,不会和队列目录冲突
+	NAMESPACE_PREFIX = "@"
+)
+
+// 不需要编码的字符
+func safe(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+}
+
+// 把一级名字编码成目录名,不安全的字节写成%XX,开头的.也编码,避免.、..和隐藏文件
+func encodeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if safe(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// encodeName的逆过程,不是encodeName生成的目录名返回false
+func decodeName(dir string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(dir); i++ {
+		if dir[i] != '%' {
+			b.WriteByte(dir[i])
+			continue
+		}
+		if i+2 >= len(dir) {
+			return "", false
+		}
+		hi, ok1 := unhex(dir[i+1])
+		lo, ok2 := unhex(dir[i+2])
+		if !ok1 || !ok2 {
+			return "", false
+		}
+		b.WriteByte(hi<<4 | lo)
+		i += 2
+	}
+	name := b.String()
+	if encodeName(name) != dir {
+		return "", false
+	}
+	return name, true
+}
+
+// 把队列名编码成相对于数据目录的路径,队列名可以是任意字节
+// 最后一个:之前的部分是命名空间,每一级命名空间是一层以@开头的目录
+func EncodeKey(key string) (string, error) {
+	if key == "" || len(key) > MAX_KEY_LEN {
+		return "", ErrInvalidKey
+	}
+	parts := strings.Split(key, NAMESPACE_SEP)
+	dirs := make([]string, len(parts))
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			if part == "" {
+				return "", ErrInvalidKey
+			}
+			dirs[i] = encodeName(part)
+		} else {
+			dirs[i] = NAMESPACE_PREFIX + encodeName(part)
+		}
+		if len(dirs[i]) > MAX_NAME_LEN {
+			return "", ErrInvalidKey
+		}
+	}
+	return filepath.Join(dirs...), nil
+}
+
+// 检查队列名能不能编码成目录
+func ValidKey(key string) bool {
+	_, err := EncodeKey(key)
+	return err == nil
+}
+
+// 命名空间目录名对应的命名空间,不是命名空间目录返回false
+func decodeNamespace(dir string) (string, bool) {
+	if !strings.HasPrefix(dir, NAMESPACE_PREFIX) {
+		return "", false
+	}
+	return decodeName(dir[len(NAMESPACE_PREFIX):])
+}
+
+// 逻辑数据库的目录,0号数据库就是数据目录本身,兼容没有数据库的目录结构
+func DatabaseDir(root string, db int) string {
+	if db == 0 {
+		return root
+	}
+	return filepath.Join(root, fmt.Sprintf("db%s%d", NAMESPACE_PREFIX, db))
+}
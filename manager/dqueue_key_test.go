@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ValidKey(t *testing.T) {
+	for _, key := range []string{"", "a:", "tenant:", strings.Repeat("a", MAX_KEY_LEN+1), strings.Repeat("\x00", 100)} {
+		if ValidKey(key) {
+			t.Log(key)
+			t.Fail()
+		}
+	}
+	for _, key := range []string{"redis-buffering", ".", "..", "../etc", "a/b", "a\x00b", ":a", "队列"} {
+		if !ValidKey(key) {
+			t.Log(key)
+			t.Fail()
+		}
+	}
+}
+
+func Test_EncodeKey(t *testing.T) {
+	cases := map[string]string{
+		"redis-buffering": "redis-buffering",
+		"tenant:queue":    "@tenant/queue",
+		"a:b:c":           "@a/@b/c",
+		":a":              "@/a",
+		".":               "%2E",
+		"..":              "%2E.",
+		"../etc":          "%2E.%2Fetc",
+		"a b%":            "a%20b%25",
+		"@a":              "%40a",
+		"\xff":            "%FF",
+	}
+	for key, path := range cases {
+		if p, err := EncodeKey(key); err != nil || p != filepath.FromSlash(path) {
+			t.Log(key, p)
+			t.Fail()
+		}
+	}
+	for _, dir := range []string{"a", "%2E.", "a%20b%25", "%FF"} {
+		name, ok := decodeName(dir)
+		if !ok || encodeName(name) != dir {
+			t.Log(dir)
+			t.Fail()
+		}
+	}
+	// 不是编码生成的目录名
+	for _, dir := range []string{"a b", "%2e", "%41", "%4", ".a", "db@1"} {
+		if _, ok := decodeName(dir); ok {
+			t.Log(dir)
+			t.Fail()
+		}
+	}
+}
+
+func Test_Namespace(t *testing.T) {
+	os.RemoveAll("test_namespace")
+	m := NewInstance("test_namespace", nil, 0)
+	for _, key := range []string{"tenant:q1", "tenant:q2", "q1", "a/b"} {
+		q, err := m.Get(key)
+		if err != nil {
+			t.Log(key, err)
+			t.Fail()
+			continue
+		}
+		q.Push([]byte(key))
+	}
+	m.Close()
+	if _, err := os.Stat("test_namespace/@tenant/q1/dqueue.idx"); err != nil {
+		t.Fail()
+	}
+
+	m = NewInstance("test_namespace", nil, 0)
+	names := m.Queues()
+	if strings.Join(names, ",") != "a/b,q1,tenant:q1,tenant:q2" {
+		t.Log(names)
+		t.Fail()
+	}
+	q, _ := m.Get("tenant:q2")
+	if r, err := q.Pop(); err != nil || string(r.Data) != "tenant:q2" {
+		t.Fail()
+	}
+	m.Close()
+}
+
+func Test_DatabaseDir(t *testing.T) {
+	if DatabaseDir("data", 0) != "data" || DatabaseDir("data", 3) != filepath.Join("data", "db@3") {
+		t.Fail()
+	}
+}
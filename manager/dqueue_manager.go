@@ -0,0 +1,354 @@
+package manager
+
+import (
+	"errors"
+	"github.com/wudikua/dqueue/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid queue name")
+	ErrOpen       = errors.New("open queue failed")
+)
+
+// 一个打开的队列
+type entry struct {
+	queue *fs.DQueueFs
+	// 打开以后关闭,同一个队列只打开一次
+	ready chan bool
+	err   error
+	// 正在使用这个队列的命令数
+	refs int
+	used time.Time
+}
+
+// 管理所有队列,每个队列只打开一次,空闲的队列自动关闭
+type DQueueManager struct {
+	root   string
+	conf   *fs.Config
+	idle   time.Duration
+	lock   sync.Mutex
+	queues map[string]*entry
+	// 正在关闭的空闲队列,关闭完成以后才能重新打开
+	closing map[string]chan bool
+	// 磁盘上已经存在的队列
+	known  map[string]bool
+	closed chan bool
+}
+
+// root是数据目录,队列名按照EncodeKey编码成root下的目录,idle大于0时关闭空闲超过idle的队列
+func NewInstance(root string, conf *fs.Config, idle time.Duration) *DQueueManager {
+	if _, err := os.Stat(root); err != nil {
+		if err := os.MkdirAll(root, 0777); err != nil {
+			log.Println(err)
+			return nil
+		}
+	}
+	instance := &DQueueManager{
+		root:    root,
+		conf:    conf,
+		idle:    idle,
+		queues:  make(map[string]*entry),
+		closing: make(map[string]chan bool),
+		known:   make(map[string]bool),
+		closed:  make(chan bool),
+	}
+	if err := instance.scan(); err != nil {
+		log.Println(err)
+		return nil
+	}
+	if idle > 0 {
+		go instance.reapLoop()
+	}
+	return instance
+}
+
+// 找到root下已经存在的队列,包含索引文件的目录就是一个队列,以@开头的目录是命名空间
+func (this *DQueueManager) scan() error {
+	return this.scanDir(this.root, "")
+}
+
+func (this *DQueueManager) scanDir(dir string, prefix string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(dir, fi.Name(), "dqueue.idx"))
+		if _, ok := decodeName(fi.Name()); !ok && err == nil && prefix == "" {
+			// 旧版本直接用队列名作为目录名,迁移到编码以后的目录
+			if key, ok := this.migrate(fi.Name()); ok {
+				this.known[key] = true
+			}
+			continue
+		}
+		if ns, ok := decodeNamespace(fi.Name()); ok {
+			if err := this.scanDir(filepath.Join(dir, fi.Name()), prefix+ns+NAMESPACE_SEP); err != nil {
+				return err
+			}
+			continue
+		}
+		name, ok := decodeName(fi.Name())
+		if !ok || name == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, fi.Name(), "dqueue.idx")); err == nil {
+			this.known[prefix+name] = true
+		}
+	}
+	return nil
+}
+
+// 把旧版本的队列目录移动到队列名编码以后的目录,目标目录已经存在的话不移动
+func (this *DQueueManager) migrate(key string) (string, bool) {
+	path, err := EncodeKey(key)
+	if err != nil {
+		log.Println("migrate", key, err)
+		return "", false
+	}
+	dst := filepath.Join(this.root, path)
+	if _, err := os.Stat(dst); err == nil {
+		log.Println("migrate", key, "skipped,", dst, "already exists")
+		return "", false
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		log.Println("migrate", key, err)
+		return "", false
+	}
+	if err := os.Rename(filepath.Join(this.root, key), dst); err != nil {
+		log.Println("migrate", key, err)
+		return "", false
+	}
+	log.Println("migrate queue", key, "to", dst)
+	return key, true
+}
+
+// 打开队列,命名空间的目录不存在时先创建
+func (this *DQueueManager) open(key string) *fs.DQueueFs {
+	path, err := EncodeKey(key)
+	if err != nil {
+		return nil
+	}
+	path = filepath.Join(this.root, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		log.Println(err)
+		return nil
+	}
+	// 死信的元数据记录队列名,死信队列由管理器打开
+	conf := fs.DefaultConfig()
+	if this.conf != nil {
+		*conf = *this.conf
+	}
+	conf.Name = key
+	conf.OpenQueue = func(name string) (*fs.DQueueFs, func(), error) {
+		q, err := this.Acquire(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return q, func() { this.Release(name) }, nil
+	}
+	return fs.NewInstanceWithConfig(path, conf)
+}
+
+// 获取队列,没有打开的话打开它
+func (this *DQueueManager) Get(key string) (*fs.DQueueFs, error) {
+	return this.get(key, false)
+}
+
+// 获取队列并增加引用计数,用完以后调用Release,有引用的队列不会被关闭
+func (this *DQueueManager) Acquire(key string) (*fs.DQueueFs, error) {
+	return this.get(key, true)
+}
+
+func (this *DQueueManager) Release(key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if e := this.queues[key]; e != nil && e.refs > 0 {
+		e.refs--
+		e.used = time.Now()
+	}
+}
+
+func (this *DQueueManager) get(key string, ref bool) (*fs.DQueueFs, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	for {
+		this.lock.Lock()
+		if this.isClosed() {
+			this.lock.Unlock()
+			return nil, fs.ErrClosed
+		}
+		if done := this.closing[key]; done != nil {
+			this.lock.Unlock()
+			<-done
+			continue
+		}
+		e := this.queues[key]
+		if e == nil {
+			// 在锁外面打开队列,不影响其他队列
+			e = &entry{ready: make(chan bool)}
+			this.queues[key] = e
+			this.lock.Unlock()
+			e.queue = this.open(key)
+			this.lock.Lock()
+			if e.queue == nil {
+				e.err = ErrOpen
+				delete(this.queues, key)
+			} else {
+				this.known[key] = true
+			}
+			close(e.ready)
+		}
+		this.lock.Unlock()
+		<-e.ready
+		if e.err != nil {
+			return nil, e.err
+		}
+		this.lock.Lock()
+		// 等待的时候可能已经被关闭了
+		if this.queues[key] != e {
+			this.lock.Unlock()
+			continue
+		}
+		if ref {
+			e.refs++
+		}
+		e.used = time.Now()
+		this.lock.Unlock()
+		return e.queue, nil
+	}
+}
+
+// 所有队列的名字,包括没有打开的
+func (this *DQueueManager) Queues() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	names := make([]string, 0, len(this.known))
+	for name, _ := range this.known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 队列已经打开成功
+func opened(e *entry) bool {
+	select {
+	case <-e.ready:
+		return e.queue != nil
+	default:
+		return false
+	}
+}
+
+func (this *DQueueManager) isClosed() bool {
+	select {
+	case <-this.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *DQueueManager) reapLoop() {
+	interval := this.idle / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.reap()
+		case <-this.closed:
+			return
+		}
+	}
+}
+
+// 关闭没有引用并且空闲超过idle的队列
+func (this *DQueueManager) reap() {
+	now := time.Now()
+	idle := make(map[string]*entry)
+	this.lock.Lock()
+	for key, e := range this.queues {
+		if !opened(e) || e.refs > 0 || now.Sub(e.used) < this.idle {
+			continue
+		}
+		idle[key] = e
+		delete(this.queues, key)
+		this.closing[key] = make(chan bool)
+	}
+	this.lock.Unlock()
+	for key, e := range idle {
+		if err := e.queue.Close(); err != nil {
+			log.Println("close idle queue", key, err)
+		}
+		this.lock.Lock()
+		close(this.closing[key])
+		delete(this.closing, key)
+		this.lock.Unlock()
+	}
+}
+
+// 关闭所有队列
+func (this *DQueueManager) Close() error {
+	this.lock.Lock()
+	if this.isClosed() {
+		this.lock.Unlock()
+		return nil
+	}
+	close(this.closed)
+	entries := make(map[string]*entry, len(this.queues))
+	for key, e := range this.queues {
+		entries[key] = e
+	}
+	this.queues = make(map[string]*entry)
+	this.lock.Unlock()
+	var err error
+	for key, e := range entries {
+		// 等待正在打开的队列
+		<-e.ready
+		if e.queue == nil {
+			continue
+		}
+		if e2 := e.queue.Close(); e2 != nil {
+			log.Println("close", key, e2)
+			if err == nil {
+				err = e2
+			}
+		}
+	}
+	return err
+}
+
+// 所有队列的状态,没有打开的队列只返回open为false
+func (this *DQueueManager) Stats() map[string]interface{} {
+	this.lock.Lock()
+	queues := make(map[string]*fs.DQueueFs, len(this.queues))
+	for key, e := range this.queues {
+		if opened(e) {
+			queues[key] = e.queue
+		}
+	}
+	stats := make(map[string]interface{}, len(this.known))
+	for name, _ := range this.known {
+		stats[name] = map[string]interface{}{"open": false}
+	}
+	this.lock.Unlock()
+	for key, q := range queues {
+		stats[key] = q.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"github.com/wudikua/dqueue/fs"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_OpenOnce(t *testing.T) {
+	os.RemoveAll("test_manager")
+	m := NewInstance("test_manager", nil, 0)
+	if _, err := m.Acquire("tenant:"); err != ErrInvalidKey {
+		t.Fail()
+	}
+	var wg sync.WaitGroup
+	queues := make([]interface{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q, err := m.Acquire("q1")
+			if err != nil {
+				t.Fail()
+			}
+			queues[i] = q
+			m.Release("q1")
+		}(i)
+	}
+	wg.Wait()
+	for i := 1; i < 10; i++ {
+		if queues[i] != queues[0] {
+			t.Fail()
+		}
+	}
+	m.Close()
+}
+
+func Test_ReapIdle(t *testing.T) {
+	os.RemoveAll("test_manager")
+	m := NewInstance("test_manager", nil, time.Hour)
+	q1, _ := m.Acquire("q1")
+	m.Get("q2")
+	m.lock.Lock()
+	for _, e := range m.queues {
+		e.used = time.Now().Add(-2 * time.Hour)
+	}
+	m.lock.Unlock()
+	m.reap()
+	// 有引用的队列不会被关闭
+	if _, err := q1.Push([]byte("abc")); err != nil {
+		t.Fail()
+	}
+	if m.queues["q2"] != nil || m.queues["q1"] == nil {
+		t.Fail()
+	}
+	m.Release("q1")
+	m.Close()
+}
+
+func Test_Scan(t *testing.T) {
+	os.RemoveAll("test_manager")
+	m := NewInstance("test_manager", nil, 0)
+	q, _ := m.Get("q1")
+	q.Push([]byte("abc"))
+	m.Close()
+	os.Mkdir("test_manager/other", 0777)
+
+	m = NewInstance("test_manager", nil, 0)
+	names := m.Queues()
+	if len(names) != 1 || names[0] != "q1" {
+		t.Log(names)
+		t.Fail()
+	}
+	if stats := m.Stats()["q1"].(map[string]interface{}); stats["open"] != false {
+		t.Fail()
+	}
+	q, _ = m.Get("q1")
+	if r, err := q.Pop(); err != nil || string(r.Data) != "abc" {
+		t.Fail()
+	}
+	m.Close()
+	if _, err := m.Get("q1"); err == nil {
+		t.Fail()
+	}
+}
+
+// 旧版本直接用队列名作为目录名,启动时迁移到编码以后的目录
+func Test_MigrateLegacy(t *testing.T) {
+	os.RemoveAll("test_manager")
+	os.Mkdir("test_manager", 0777)
+	for _, key := range []string{"tenant:q", "a b", "plain"} {
+		q := fs.NewInstance("test_manager/" + key)
+		q.Push([]byte(key))
+		q.Close()
+	}
+	m := NewInstance("test_manager", nil, 0)
+	names := m.Queues()
+	if len(names) != 3 {
+		t.Log(names)
+		t.Fail()
+	}
+	for _, key := range []string{"tenant:q", "a b", "plain"} {
+		q, err := m.Get(key)
+		if err != nil {
+			t.Fail()
+			continue
+		}
+		if r, err := q.Pop(); err != nil || string(r.Data) != key {
+			t.Fail()
+		}
+	}
+	if _, err := os.Stat("test_manager/tenant:q"); err == nil {
+		t.Fail()
+	}
+	if _, err := os.Stat("test_manager/@tenant/q/dqueue.idx"); err != nil {
+		t.Fail()
+	}
+	m.Close()
+}
+
+// 死信队列由管理器按照名字打开
+func Test_DeadLetterQueue(t *testing.T) {
+	os.RemoveAll("test_manager")
+	m := NewInstance("test_manager", nil, 0)
+	q, _ := m.Get("jobs")
+	q.SetDeadLetter("jobs:dlq", 1)
+	q.Push([]byte("abc"))
+	r, _ := q.Reserve(time.Minute)
+	q.Nack(r.Id)
+	q.Reserve(time.Minute)
+	dlq, _ := m.Get("jobs:dlq")
+	rec, err := dlq.Pop()
+	if err != nil || string(rec.Data) != "abc" || rec.Headers["x-dlq-queue"] != "jobs" {
+		t.Fail()
+	}
+	m.Close()
+}
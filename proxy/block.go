@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/wudikua/dqueue/db"
+	"github.com/wudikua/dqueue/fs"
+	"sync"
+	"time"
+)
+
+// 阻塞操作的结果
+type blockResult struct {
+	value interface{}
+	err   error
+}
+
+// 一个阻塞在若干队列上的客户端
+type blockedClient struct {
+	keys []string
+	// 从key对应的队列取数据
+	pop   func(key string) (interface{}, error)
+	reply chan blockResult
+	// 正在被某个队列服务,pop的时候不持有lock
+	serving bool
+	// 服务期间超时或者关闭了,服务结束以后直接返回
+	expired bool
+}
+
+// 管理阻塞的客户端,每个队列上的客户端按照阻塞的先后顺序被服务
+type blockRegistry struct {
+	lock     sync.Mutex
+	waiting  map[string][]*blockedClient
+	watching map[string]bool
+	queue    func(key string) *fs.DQueueFs
+	closed   bool
+}
+
+func newBlockRegistry(queue func(key string) *fs.DQueueFs) *blockRegistry {
+	return &blockRegistry{
+		waiting:  make(map[string][]*blockedClient),
+		watching: make(map[string]bool),
+		queue:    queue,
+	}
+}
+
+// 队列为空,和磁盘错误区分开
+func isEmpty(err error) bool {
+	return errors.Is(err, db.ErrEmpty) || errors.Is(err, db.ErrNew)
+}
+
+// 阻塞等待任意一个key有数据,timeout为0时一直等待,超时返回nil
+func (this *blockRegistry) wait(keys []string, timeout time.Duration, pop func(key string) (interface{}, error)) (interface{}, error) {
+	c := &blockedClient{
+		keys:  keys,
+		pop:   pop,
+		reply: make(chan blockResult, 1),
+	}
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return nil, nil
+	}
+	for _, key := range keys {
+		this.waiting[key] = append(this.waiting[key], c)
+		if !this.watching[key] {
+			this.watching[key] = true
+			go this.watch(key)
+		}
+	}
+	this.lock.Unlock()
+	// 注册之前可能已经有数据写入
+	for _, key := range keys {
+		this.serve(key)
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	select {
+	case r := <-c.reply:
+		return r.value, r.err
+	case <-deadline:
+	}
+	this.lock.Lock()
+	// 超时的同时可能已经被服务了
+	select {
+	case r := <-c.reply:
+		this.lock.Unlock()
+		return r.value, r.err
+	default:
+	}
+	if c.serving {
+		// 正在取数据,取到的数据不能丢弃,等服务结束
+		c.expired = true
+		this.lock.Unlock()
+		r := <-c.reply
+		return r.value, r.err
+	}
+	this.remove(c)
+	this.lock.Unlock()
+	return nil, nil
+}
+
+// 把客户端从所有队列的等待列表删除,调用者需要持有lock
+func (this *blockRegistry) remove(c *blockedClient) {
+	for _, key := range c.keys {
+		clients := this.waiting[key]
+		for i, v := range clients {
+			if v == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(this.waiting, key)
+		} else {
+			this.waiting[key] = clients
+		}
+	}
+}
+
+// 第一个没有正在被服务的客户端,调用者需要持有lock
+func (this *blockRegistry) first(key string) *blockedClient {
+	for _, c := range this.waiting[key] {
+		if !c.serving {
+			return c
+		}
+	}
+	return nil
+}
+
+// 按照先后顺序把key上的数据交给等待的客户端
+// 取数据会读磁盘,不持有lock,取数据的期间客户端标记为正在服务,其他队列跳过它
+func (this *blockRegistry) serve(key string) {
+	for {
+		this.lock.Lock()
+		c := this.first(key)
+		if c == nil {
+			this.lock.Unlock()
+			return
+		}
+		c.serving = true
+		this.lock.Unlock()
+
+		v, err := c.pop(key)
+
+		this.lock.Lock()
+		c.serving = false
+		if err != nil && isEmpty(err) {
+			// 队列已经空了,客户端留在原来的位置继续等待
+			if c.expired {
+				this.remove(c)
+				c.reply <- blockResult{}
+			}
+			this.lock.Unlock()
+			return
+		}
+		this.remove(c)
+		c.reply <- blockResult{value: v, err: err}
+		this.lock.Unlock()
+	}
+}
+
+// 监听队列的PUSH事件,没有等待的客户端时退出
+func (this *blockRegistry) watch(key string) {
+	q := this.queue(key)
+	if q == nil {
+		this.lock.Lock()
+		delete(this.watching, key)
+		this.lock.Unlock()
+		return
+	}
+	for {
+		event := q.PushEvent()
+		this.serve(key)
+		this.lock.Lock()
+		if len(this.waiting[key]) == 0 {
+			delete(this.watching, key)
+			this.lock.Unlock()
+			return
+		}
+		this.lock.Unlock()
+		select {
+		case <-event:
+		case <-time.After(time.Second):
+			// 定期检查客户端是否都已经超时
+		}
+	}
+}
+
+// 关闭的时候让所有阻塞的客户端像超时一样返回
+func (this *blockRegistry) close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.closed = true
+	for _, clients := range this.waiting {
+		for _, c := range clients {
+			if c.serving {
+				// 正在取数据的客户端由serve返回结果
+				c.expired = true
+				continue
+			}
+			select {
+			case c.reply <- blockResult{}:
+			default:
+			}
+		}
+	}
+	this.waiting = make(map[string][]*blockedClient)
+}
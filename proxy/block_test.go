@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"github.com/wudikua/dqueue/db"
+	"github.com/wudikua/dqueue/fs"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestRegistry() (*blockRegistry, *fs.DQueueFs) {
+	os.RemoveAll("test_block")
+	q := fs.NewInstance("test_block")
+	return newBlockRegistry(func(key string) *fs.DQueueFs {
+		return q
+	}), q
+}
+
+func popFrom(q *fs.DQueueFs) func(key string) (interface{}, error) {
+	return func(key string) (interface{}, error) {
+		r, err := q.Pop()
+		if err != nil {
+			return nil, err
+		}
+		return string(r.Data), nil
+	}
+}
+
+func Test_BlockTimeout(t *testing.T) {
+	r, q := newTestRegistry()
+	v, err := r.wait([]string{"test_block"}, time.Millisecond*10, popFrom(q))
+	if v != nil || err != nil {
+		t.Fail()
+	}
+	if len(r.waiting) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_BlockWakeByPush(t *testing.T) {
+	r, q := newTestRegistry()
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		q.Push([]byte("abc"))
+	}()
+	v, err := r.wait([]string{"test_block"}, time.Second, popFrom(q))
+	if err != nil || v != "abc" {
+		t.Fail()
+	}
+}
+
+func Test_BlockFifo(t *testing.T) {
+	r, q := newTestRegistry()
+	first := make(chan interface{})
+	go func() {
+		v, _ := r.wait([]string{"test_block"}, time.Second, popFrom(q))
+		first <- v
+	}()
+	time.Sleep(time.Millisecond * 10)
+	second := make(chan interface{})
+	go func() {
+		v, _ := r.wait([]string{"test_block"}, time.Second, popFrom(q))
+		second <- v
+	}()
+	time.Sleep(time.Millisecond * 10)
+	q.Push([]byte("abc"))
+	if v := <-first; v != "abc" {
+		t.Fail()
+	}
+	q.Push([]byte("def"))
+	if v := <-second; v != "def" {
+		t.Fail()
+	}
+}
+
+func Test_BlockClose(t *testing.T) {
+	r, q := newTestRegistry()
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		r.close()
+	}()
+	v, err := r.wait([]string{"test_block"}, 0, popFrom(q))
+	if v != nil || err != nil {
+		t.Fail()
+	}
+	// 关闭以后不再阻塞
+	v, err = r.wait([]string{"test_block"}, 0, popFrom(q))
+	if v != nil || err != nil {
+		t.Fail()
+	}
+}
+
+// 取数据的时候不持有锁,慢的队列不影响其他队列的客户端,取数据期间超时的客户端仍然拿到数据
+func Test_BlockSlowPop(t *testing.T) {
+	r, q := newTestRegistry()
+	q.Push([]byte("abc"))
+	release := make(chan bool)
+	first := make(chan interface{})
+	go func() {
+		v, _ := r.wait([]string{"slow"}, time.Millisecond*10, func(key string) (interface{}, error) {
+			<-release
+			return popFrom(q)(key)
+		})
+		first <- v
+	}()
+	time.Sleep(time.Millisecond * 10)
+	start := time.Now()
+	v, err := r.wait([]string{"fast"}, time.Millisecond*10, func(key string) (interface{}, error) {
+		return nil, db.ErrEmpty
+	})
+	if v != nil || err != nil || time.Since(start) > time.Millisecond*500 {
+		t.Fail()
+	}
+	close(release)
+	if v := <-first; v != "abc" {
+		t.Fail()
+	}
+}
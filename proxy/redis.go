@@ -2,57 +2,988 @@ package proxy
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"github.com/wudikua/dqueue/db"
 	"github.com/wudikua/dqueue/fs"
+	"github.com/wudikua/dqueue/manager"
 	redis "github.com/wudikua/go-redis-server"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// 所有连接共享的状态
+type shared struct {
+	root string
+	conf *fs.Config
+	idle time.Duration
+	// 可以选择的逻辑数据库个数
+	databases int
+	// 已经打开的逻辑数据库,第一次选择的时候打开
+	opened map[int]*database
+	dbLock sync.Mutex
+	// 兼容旧版本,RPOP和LPOP一样从头部取出,关闭以后RPOP返回错误
+	rpopFifo bool
+	lock     sync.Mutex
+	// 关闭的时候等待正在执行的命令
+	closing  bool
+	inflight sync.WaitGroup
+}
+
+// 一个逻辑数据库,队列在manager.DatabaseDir(root, n)下
+type database struct {
+	manager *manager.DQueueManager
+	sub     map[string][]*redis.ChannelWriter
+	block   *blockRegistry
+}
+
+// 每个连接一个handler,SELECT只改变这个连接使用的数据库
 type DQueueHandler struct {
-	queues map[string]*fs.DQueueFs
-	sub    map[string][]*redis.ChannelWriter
+	*shared
+	*database
+	db int
 }
 
+var ErrShutdown = errors.New("server is shutting down")
+
 var handler *DQueueHandler
 
+// 获取队列,不存在的话创建,命令执行完以后调用release,使用中的队列不会因为空闲被关闭
+func (h *DQueueHandler) queue(key string) (*fs.DQueueFs, error) {
+	return h.manager.Acquire(key)
+}
+
+func (h *DQueueHandler) release(key string) {
+	h.manager.Release(key)
+}
+
+// 打开第n个逻辑数据库,已经打开的直接返回
+func (this *shared) open(n int) (*database, error) {
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+	if d, ok := this.opened[n]; ok {
+		return d, nil
+	}
+	queues := manager.NewInstance(manager.DatabaseDir(this.root, n), this.conf, this.idle)
+	if queues == nil {
+		return nil, fmt.Errorf("open DB %d failed", n)
+	}
+	d := &database{
+		manager: queues,
+		sub:     make(map[string][]*redis.ChannelWriter, 1),
+		block: newBlockRegistry(func(key string) *fs.DQueueFs {
+			q, err := queues.Get(key)
+			if err != nil {
+				return nil
+			}
+			return q
+		}),
+	}
+	if this.opened == nil {
+		this.opened = make(map[int]*database)
+	}
+	this.opened[n] = d
+	return d, nil
+}
+
+// 新连接的handler,使用第n个逻辑数据库
+func (this *shared) connect(n int) (*DQueueHandler, error) {
+	d, err := this.open(n)
+	if err != nil {
+		return nil, err
+	}
+	return &DQueueHandler{shared: this, database: d, db: n}, nil
+}
+
+// 开始执行一个命令,正在关闭的时候拒绝新的命令
+func (h *DQueueHandler) enter() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closing {
+		return ErrShutdown
+	}
+	h.inflight.Add(1)
+	return nil
+}
+
+func (h *DQueueHandler) leave() {
+	h.inflight.Done()
+}
+
+// 拒绝新的命令,唤醒阻塞的客户端,等待正在执行的命令完成以后关闭所有数据库的队列
+func (this *shared) shutdown() {
+	this.lock.Lock()
+	this.closing = true
+	this.lock.Unlock()
+	this.dbLock.Lock()
+	opened := make([]*database, 0, len(this.opened))
+	for _, d := range this.opened {
+		opened = append(opened, d)
+	}
+	this.dbLock.Unlock()
+	for _, d := range opened {
+		d.block.close()
+	}
+	this.inflight.Wait()
+	for _, d := range opened {
+		if err := d.manager.Close(); err != nil {
+			log.Println("close", err)
+		}
+	}
+}
+
+// 队列的头部(LEFT)是最早写入的数据,尾部(RIGHT)是最后写入的数据
+// 数据只能从尾部写入,从头部取出,RPUSH和LPOP组成先进先出的队列
+var errTailPop = errors.New("RPOP is not supported, the queue can only pop from the head, use LPOP")
+
+// LPOP key 从头部取出最早写入的数据
+func (h *DQueueHandler) LPOP(key string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	r, err := h.pop(key)
+	if r == nil {
+		return nil, err
+	}
+	return r.Data, nil
+}
+
+// RPOP key 兼容模式下和LPOP一样从头部取出
 func (h *DQueueHandler) RPOP(key string) ([]byte, error) {
-	if h.queues[key] == nil {
-		h.queues[key] = fs.NewInstance(key)
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	if !h.rpopFifo {
+		return nil, errTailPop
+	}
+	r, err := h.pop(key)
+	if r == nil {
+		return nil, err
+	}
+	return r.Data, nil
+}
+
+// LPOPMSG key 从头部取出一条数据和它的元数据
+// 返回[id, seq, time, value, field, value, ...],time是毫秒时间戳,后面是消息头
+func (h *DQueueHandler) LPOPMSG(key string) ([][]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	r, err := h.pop(key)
+	if r == nil {
+		return nil, err
+	}
+	reply := make([][]byte, 0, 4+len(r.Headers)*2)
+	reply = append(reply,
+		[]byte(r.Id()),
+		[]byte(strconv.FormatInt(r.Seq, 10)),
+		[]byte(strconv.FormatInt(r.Time/int64(time.Millisecond), 10)),
+		r.Data)
+	fields := make([]string, 0, len(r.Headers))
+	for field := range r.Headers {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		reply = append(reply, []byte(field), []byte(r.Headers[field]))
+	}
+	return reply, nil
+}
+
+// 队列为空时返回nil
+func (h *DQueueHandler) pop(key string) (*fs.Record, error) {
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(key)
+	r, err := q.Pop()
+	if err != nil {
+		// 队列为空返回nil,其他错误返回给客户端
+		if isEmpty(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// RPUSHMSG key value [field value ...] 写入一条带消息头的数据,返回队列长度
+func (h *DQueueHandler) RPUSHMSG(key string, value []byte, fields ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	if len(fields)%2 != 0 {
+		return 0, errors.New("wrong number of arguments")
+	}
+	headers := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		headers[string(fields[i])] = string(fields[i+1])
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	return q.PushWithHeaders(value, headers)
+}
+
+// RPUSHDELAY key ms value [value ...] 写入延迟数据,ms毫秒以后才能出队,返回队列长度
+func (h *DQueueHandler) RPUSHDELAY(key string, delay string, values ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	ms, err := strconv.ParseInt(delay, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, errors.New("value is not an integer or out of range")
+	}
+	if len(values) == 0 {
+		return 0, errors.New("wrong number of arguments for 'rpushdelay' command")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	return q.PushDelayed(values, time.Now().Add(time.Duration(ms)*time.Millisecond))
+}
+
+// RPUSHPRI key priority value [value ...] 写入指定优先级的通道,返回所有通道的总长度
+func (h *DQueueHandler) RPUSHPRI(key string, priority string, values ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	p, err := strconv.Atoi(priority)
+	if err != nil {
+		return 0, errors.New("value is not an integer or out of range")
+	}
+	if len(values) == 0 {
+		return 0, errors.New("wrong number of arguments for 'rpushpri' command")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	return q.PushPriority(values, p)
+}
+
+// LANES key n STRICT|WEIGHTED [weight ...] 设置队列的优先级通道个数、取数据的策略和每个通道的权重
+func (h *DQueueHandler) LANES(key string, n string, policy string, weights ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	lanes, err := strconv.Atoi(n)
+	if err != nil {
+		return 0, errors.New("value is not an integer or out of range")
+	}
+	p, err := fs.ParseLanePolicy(policy)
+	if err != nil {
+		return 0, err
+	}
+	ws := make([]int, len(weights))
+	for i, w := range weights {
+		if ws[i], err = strconv.Atoi(string(w)); err != nil || ws[i] <= 0 {
+			return 0, errors.New("weight must be a positive integer")
+		}
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
 	}
-	_, v, _ := h.queues[key].Pop()
-	return v, nil
+	defer h.release(key)
+	if err := q.SetLanes(lanes, p, ws); err != nil {
+		return 0, err
+	}
+	return lanes, nil
 }
 
-func (h *DQueueHandler) RPUSH(key string, value []byte) (int, error) {
-	if h.queues[key] == nil {
-		h.queues[key] = fs.NewInstance(key)
+// RPUSHID key id value 幂等写入,去重窗口内已经写入过id的话不再写入,都返回队列长度,没有配置去重窗口时返回错误
+func (h *DQueueHandler) RPUSHID(key string, id string, value []byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
 	}
-	length, err := h.queues[key].Push(value)
+	defer h.release(key)
+	length, _, err := q.PushUnique(value, id, nil)
 	return length, err
 }
 
+// LPUSH key value [value ...] 磁盘队列不能从头部写入
+func (h *DQueueHandler) LPUSH(key string, values ...[]byte) (int, error) {
+	return 0, errors.New("LPUSH is not supported, the queue can only push to the tail, use RPUSH")
+}
+
+// LLEN key 队列长度
+func (h *DQueueHandler) LLEN(key string) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	return q.Len(), nil
+}
+
+// LINDEX key index 读取下标为index的数据,0是头部,-1是尾部,不取出数据
+func (h *DQueueHandler) LINDEX(key string, index string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(key)
+	return q.Index(i)
+}
+
+// LRANGE key start stop 读取下标从start到stop的数据,不取出数据
+func (h *DQueueHandler) LRANGE(key string, start string, stop string) ([][]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	i, err1 := strconv.Atoi(start)
+	j, err2 := strconv.Atoi(stop)
+	if err1 != nil || err2 != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(key)
+	return q.Range(i, j)
+}
+
+// RPUSH key value [value ...] 多个value原子的写入
+func (h *DQueueHandler) RPUSH(key string, values ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	if len(values) == 0 {
+		return 0, errors.New("wrong number of arguments for 'rpush' command")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	return q.PushBatch(values)
+}
+
+// RESERVE key timeout 取出一条消息,返回投递id和数据,timeout秒内没有ACK会被重新投递
+func (h *DQueueHandler) RESERVE(key string, timeout string) ([][]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	seconds, err := strconv.Atoi(timeout)
+	if err != nil || seconds <= 0 {
+		return nil, errors.New("timeout is not a positive integer")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(key)
+	r, err := q.Reserve(time.Duration(seconds) * time.Second)
+	if err != nil {
+		// 队列为空
+		if isEmpty(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return [][]byte{
+		[]byte(strconv.FormatUint(r.Id, 10)),
+		r.Data,
+	}, nil
+}
+
+// ACK key id 确认消息处理完成
+func (h *DQueueHandler) ACK(key string, id string) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	return h.settle(key, id, func(q *fs.DQueueFs, deliveryId uint64) error {
+		return q.Ack(deliveryId)
+	})
+}
+
+// NACK key id [reason] 消息处理失败,重新投递,reason在移动到死信队列的时候记录下来
+func (h *DQueueHandler) NACK(key string, id string, reason ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	if len(reason) > 1 {
+		return 0, errors.New("wrong number of arguments for 'nack' command")
+	}
+	return h.settle(key, id, func(q *fs.DQueueFs, deliveryId uint64) error {
+		if len(reason) == 0 {
+			return q.Nack(deliveryId)
+		}
+		return q.NackWithReason(deliveryId, string(reason[0]))
+	})
+}
+
+// REJECT key id reason 消息处理失败并且不需要重试,立刻移动到死信队列
+func (h *DQueueHandler) REJECT(key string, id string, reason string) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	return h.settle(key, id, func(q *fs.DQueueFs, deliveryId uint64) error {
+		return q.Reject(deliveryId, reason)
+	})
+}
+
+func (h *DQueueHandler) settle(key string, id string, fn func(q *fs.DQueueFs, deliveryId uint64) error) (int, error) {
+	deliveryId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid delivery id")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	err = fn(q, deliveryId)
+	if err == fs.ErrUnknownDelivery {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// DLQ key dlq maxAttempts 设置死信队列,投递maxAttempts次都没有确认的消息移动到dlq,0表示只有REJECT的消息
+// dlq为空字符串时去掉死信队列
+func (h *DQueueHandler) DLQ(key string, dlq string, maxAttempts string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	n, err := strconv.Atoi(maxAttempts)
+	if err != nil || n < 0 {
+		return nil, errors.New("max attempts is not a non-negative integer")
+	}
+	if dlq != "" && !manager.ValidKey(dlq) {
+		return nil, manager.ErrInvalidKey
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(key)
+	if err := q.SetDeadLetter(dlq, n); err != nil {
+		return nil, err
+	}
+	return []byte("OK"), nil
+}
+
+// DLQPEEK dlq count 查看死信队列头部的count条消息,每条消息返回[id, queue, attempts, reason, value]
+func (h *DQueueHandler) DLQPEEK(key string, count string) ([][]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(key)
+	records, err := q.Peek(n)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, 0, len(records)*5)
+	for _, r := range records {
+		ret = append(ret,
+			[]byte(r.Id()),
+			[]byte(r.Headers[fs.DLQ_HEADER_QUEUE]),
+			[]byte(r.Headers[fs.DLQ_HEADER_ATTEMPTS]),
+			[]byte(r.Headers[fs.DLQ_HEADER_REASON]),
+			r.Data)
+	}
+	return ret, nil
+}
+
+// DLQREDRIVE dlq [count] 把死信队列头部的count条消息移回原来的队列,默认全部移回,返回移动的条数
+func (h *DQueueHandler) DLQREDRIVE(key string, count ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	n := -1
+	if len(count) > 1 {
+		return 0, errors.New("wrong number of arguments for 'dlqredrive' command")
+	}
+	if len(count) == 1 {
+		var err error
+		if n, err = strconv.Atoi(string(count[0])); err != nil || n < 0 {
+			return 0, errors.New("value is not an integer or out of range")
+		}
+	}
+	dlq, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	moved := 0
+	for n < 0 || moved < n {
+		records, err := dlq.Peek(1)
+		if err != nil {
+			return moved, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		source := records[0].Headers[fs.DLQ_HEADER_QUEUE]
+		if source == "" {
+			return moved, fs.ErrNotDeadLetter
+		}
+		src, err := h.queue(source)
+		if err != nil {
+			return moved, err
+		}
+		_, err = dlq.RedriveTo(src, source)
+		h.release(source)
+		if err == fs.ErrNotDeadLetter {
+			// 头部的消息被其他客户端取走了
+			continue
+		}
+		if err != nil {
+			if isEmpty(err) {
+				break
+			}
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// RPOPLPUSH source destination 把source的下一条数据移动到destination,兼容模式下才可以使用
+func (h *DQueueHandler) RPOPLPUSH(source string, destination string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	if !h.rpopFifo {
+		return nil, errTailPop
+	}
+	return h.move(source, destination, -1)
+}
+
+// BRPOPLPUSH source destination timeout 阻塞版本的RPOPLPUSH,timeout为0时一直等待
+func (h *DQueueHandler) BRPOPLPUSH(source string, destination string, timeout string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	if !h.rpopFifo {
+		return nil, errTailPop
+	}
+	t, err := parseTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return h.move(source, destination, t)
+}
+
+// LMOVE source destination LEFT RIGHT
+// 磁盘队列只能从头部取出,从尾部写入,兼容模式下不检查方向
+func (h *DQueueHandler) LMOVE(source string, destination string, wherefrom string, whereto string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	if err := h.checkDirection(wherefrom, whereto); err != nil {
+		return nil, err
+	}
+	return h.move(source, destination, -1)
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func (h *DQueueHandler) BLMOVE(source string, destination string, wherefrom string, whereto string, timeout string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	if err := h.checkDirection(wherefrom, whereto); err != nil {
+		return nil, err
+	}
+	t, err := parseTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return h.move(source, destination, t)
+}
+
+// 移动数据,timeout小于0不阻塞,等于0一直阻塞
+func (h *DQueueHandler) move(source string, destination string, timeout time.Duration) ([]byte, error) {
+	src, err := h.queue(source)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(source)
+	dst, err := h.queue(destination)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(destination)
+	bs, err := src.MoveTo(dst)
+	if err == nil {
+		return bs, nil
+	}
+	if !isEmpty(err) {
+		return nil, err
+	}
+	if timeout < 0 {
+		return nil, nil
+	}
+	v, err := h.block.wait([]string{source}, timeout, func(key string) (interface{}, error) {
+		return src.MoveTo(dst)
+	})
+	if v == nil {
+		return nil, err
+	}
+	return v.([]byte), err
+}
+
+// BRPOP key [key ...] timeout 兼容模式下和BLPOP一样
+func (h *DQueueHandler) BRPOP(args ...[]byte) ([][]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	if !h.rpopFifo {
+		return nil, errTailPop
+	}
+	return h.bpop(args)
+}
+
+// BLPOP key [key ...] timeout 阻塞直到任意一个队列有数据,返回[key, value],取出最早写入的数据
+func (h *DQueueHandler) BLPOP(args ...[]byte) ([][]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	return h.bpop(args)
+}
+
+func (h *DQueueHandler) bpop(args [][]byte) ([][]byte, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments")
+	}
+	timeout, err := parseTimeout(string(args[len(args)-1]))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(args)-1)
+	queues := make(map[string]*fs.DQueueFs, len(keys))
+	for i, key := range args[:len(args)-1] {
+		keys[i] = string(key)
+		if queues[keys[i]] != nil {
+			continue
+		}
+		q, err := h.queue(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		defer h.release(keys[i])
+		queues[keys[i]] = q
+	}
+	pop := func(key string) (interface{}, error) {
+		r, err := queues[key].Pop()
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{[]byte(key), r.Data}, nil
+	}
+	// 按照key的顺序先尝试一次
+	for _, key := range keys {
+		v, err := pop(key)
+		if err == nil {
+			return v.([][]byte), nil
+		}
+		if !isEmpty(err) {
+			return nil, err
+		}
+	}
+	v, err := h.block.wait(keys, timeout, pop)
+	if v == nil {
+		return nil, err
+	}
+	return v.([][]byte), err
+}
+
+func validDirection(where string) bool {
+	where = strings.ToUpper(where)
+	return where == "LEFT" || where == "RIGHT"
+}
+
+// 只支持从头部取出写入尾部
+func (h *DQueueHandler) checkDirection(wherefrom string, whereto string) error {
+	if !validDirection(wherefrom) || !validDirection(whereto) {
+		return errors.New("syntax error")
+	}
+	if h.rpopFifo {
+		return nil
+	}
+	if strings.ToUpper(wherefrom) != "LEFT" || strings.ToUpper(whereto) != "RIGHT" {
+		return errors.New("only LEFT RIGHT is supported, the queue pops from the head and pushes to the tail")
+	}
+	return nil
+}
+
+// 解析秒为单位的超时时间,支持小数
+func parseTimeout(timeout string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(timeout, 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("timeout is not a float or out of range")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// XGROUP CREATE key group 0|$ 创建消费组,0从最早的数据开始读,$只读之后写入的数据
+// XGROUP DESTROY key group 删除消费组
+func (h *DQueueHandler) XGROUP(args ...[]byte) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	if len(args) < 3 {
+		return 0, errors.New("wrong number of arguments for 'xgroup' command")
+	}
+	q, err := h.queue(string(args[1]))
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(string(args[1]))
+	name := string(args[2])
+	switch strings.ToUpper(string(args[0])) {
+	case "CREATE":
+		if len(args) != 4 || (string(args[3]) != "0" && string(args[3]) != "$") {
+			return 0, errors.New("syntax error")
+		}
+		if err := q.CreateGroup(name, string(args[3]) == "0"); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	case "DESTROY":
+		if err := q.DeleteGroup(name); err != nil {
+			if err == fs.ErrGroupUnknown {
+				return 0, nil
+			}
+			return 0, err
+		}
+		return 1, nil
+	}
+	return 0, errors.New("unknown subcommand " + string(args[0]))
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] STREAMS key >
+// 返回[id, value, id, value...],消费组的读游标读完即提交
+func (h *DQueueHandler) XREADGROUP(args ...[]byte) ([][]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	if len(args) < 6 || strings.ToUpper(string(args[0])) != "GROUP" {
+		return nil, errors.New("syntax error")
+	}
+	name := string(args[1])
+	count := 1
+	block := time.Duration(-1)
+	i := 3
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				return nil, errors.New("value is not an integer or out of range")
+			}
+			count = n
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			ms, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || ms < 0 {
+				return nil, errors.New("timeout is not an integer or out of range")
+			}
+			block = time.Duration(ms) * time.Millisecond
+			i++
+		case "STREAMS":
+			goto streams
+		default:
+			return nil, errors.New("syntax error")
+		}
+	}
+streams:
+	// 只支持一个队列,并且只读新的数据
+	if i+3 != len(args) || string(args[i+2]) != ">" {
+		return nil, errors.New("syntax error")
+	}
+	key := string(args[i+1])
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release(key)
+	read := func(key string) (interface{}, error) {
+		records, err := q.ReadGroup(name, count)
+		if err != nil {
+			return nil, err
+		}
+		reply := make([][]byte, 0, len(records)*2)
+		for _, r := range records {
+			reply = append(reply, []byte(r.Id()), r.Data)
+		}
+		return reply, nil
+	}
+	v, err := read(key)
+	if err != nil && isEmpty(err) {
+		if block < 0 {
+			return nil, nil
+		}
+		v, err = h.block.wait([]string{key}, block, read)
+	}
+	if v == nil {
+		return nil, err
+	}
+	return v.([][]byte), err
+}
+
+// SEEK key ID dbNo-pos|SEQ seq|TIME ms 移动读游标,回退重新消费或者跳过数据,返回新的队列长度
+func (h *DQueueHandler) SEEK(key string, by string, value string) (int, error) {
+	if err := h.enter(); err != nil {
+		return 0, err
+	}
+	defer h.leave()
+	q, err := h.queue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer h.release(key)
+	if err := seek(q, by, value); err != nil {
+		return 0, err
+	}
+	return q.Len(), nil
+}
+
+// 按照位置、序号或者毫秒时间戳移动读游标
+func seek(q *fs.DQueueFs, by string, value string) error {
+	switch strings.ToUpper(by) {
+	case "ID":
+		dbNo, pos, err := fs.ParseId(value)
+		if err != nil {
+			return err
+		}
+		return q.Seek(dbNo, pos)
+	case "SEQ":
+		seq, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+		return q.SeekSeq(seq)
+	case "TIME":
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+		return q.SeekTime(time.Unix(0, ms*int64(time.Millisecond)))
+	}
+	return errors.New("syntax error")
+}
+
 func (h *DQueueHandler) GREET() ([]byte, error) {
-	status := make([]string, len(h.queues))
-	i := 0
-	for queueName, _ := range handler.queues {
-		status[i] = queueName
-		i++
+	if err := h.enter(); err != nil {
+		return nil, err
 	}
-	b, err := json.Marshal(status)
+	defer h.leave()
+	b, err := json.Marshal(h.manager.Queues())
 	return b, err
 }
 
+// SELECT index 选择这个连接使用的逻辑数据库,其他连接不受影响
+func (h *DQueueHandler) SELECT(index string) ([]byte, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	n, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, errors.New("invalid DB index")
+	}
+	if n < 0 || n >= h.databases {
+		return nil, errors.New("DB index is out of range")
+	}
+	d, err := h.open(n)
+	if err != nil {
+		return nil, err
+	}
+	h.database = d
+	h.db = n
+	return []byte("OK"), nil
+}
+
 func (h *DQueueHandler) SUBSCRIBE(channels ...[]byte) (*redis.MultiChannelWriter, error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
 	ret := &redis.MultiChannelWriter{
 		Chans: make([]*redis.ChannelWriter, 0, len(channels)),
 	}
+	// SYNC在后台执行,之后连接上的SELECT不影响正在同步的数据库
+	conn := *h
 	// 订阅多个channels
 	for _, key := range channels {
 		cw := &redis.ChannelWriter{
@@ -63,6 +994,7 @@ func (h *DQueueHandler) SUBSCRIBE(channels ...[]byte) (*redis.MultiChannelWriter
 			},
 			Channel: make(chan []interface{}),
 		}
+		h.lock.Lock()
 		if h.sub[string(key)] == nil {
 			// 当前channel一个订阅者
 			h.sub[string(key)] = []*redis.ChannelWriter{cw}
@@ -70,8 +1002,9 @@ func (h *DQueueHandler) SUBSCRIBE(channels ...[]byte) (*redis.MultiChannelWriter
 			// 当前channel多个订阅者
 			h.sub[string(key)] = append(h.sub[string(key)], cw)
 		}
+		h.lock.Unlock()
 		ret.Chans = append(ret.Chans, cw)
-		go h.SYNC(string(key))
+		go conn.SYNC(string(key))
 	}
 	return ret, nil
 }
@@ -80,16 +1013,17 @@ func (h *DQueueHandler) SYNC(key string) ([]byte, error) {
 	defer func() {
 		log.Println("sync", key, "end")
 	}()
+	h.lock.Lock()
 	v, exists := h.sub[key]
+	h.lock.Unlock()
 	if !exists {
 		return nil, nil
 	}
-fetch_queue:
-	q, exists := h.queues[key]
-	if !exists {
-		h.queues[key] = fs.NewInstance(key)
-		goto fetch_queue
+	q, err := h.queue(key)
+	if err != nil {
+		return nil, err
 	}
+	defer h.release(key)
 	ouput := make(chan interface{}, 1024*1024)
 	quit := make(chan bool)
 	// 主库的变更全部会写入到output
@@ -126,17 +1060,148 @@ func ListenAndServeRedis() {
 	flag.StringVar(&host, "h", "127.0.0.1", "host")
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	flag.IntVar(&port, "p", 9008, "port")
+	var retire = flag.String("retire", "delete", "consumed db files: delete|archive|gzip|keep")
+	var archive = flag.String("archive", "", "archive dir of consumed db files")
+	var seekWindow = flag.Int("seek-window", 0, "consumed db files kept in the queue dir so SEEK can move back to them")
+	var appendfsync = flag.String("appendfsync", "everysec", "fsync policy: always|everysec|no")
+	var segmentSize = flag.Int("segment-size", db.MAX_FILE_LIMIT, "size of each db file in bytes")
+	var maxBytes = flag.Int64("max-bytes", 0, "max backlog bytes of each queue, 0 is unlimited")
+	var maxRecords = flag.Int("max-records", 0, "max backlog records of each queue, 0 is unlimited")
+	var maxAge = flag.Duration("max-age", 0, "max age of backlog db files, 0 is unlimited")
+	var retention = flag.String("retention", "reject", "when a limit is hit: reject|drop")
+	var dir = flag.String("dir", ".", "data root dir of all queues")
+	var database = flag.Int("db", 0, "logical database of new connections, SELECT changes it per connection, db N is stored in dir/db@N")
+	var databases = flag.Int("databases", 16, "number of logical databases SELECT can choose")
+	var rpopFifo = flag.Bool("rpop-fifo", true, "RPOP pops from the head like LPOP, for clients of old versions")
+	var idleClose = flag.Duration("idle-close", 10*time.Minute, "close queues idle longer than this, 0 never closes")
+	var delayBucket = flag.Duration("delay-bucket", fs.DEFAULT_DELAY_BUCKET, "time bucket width of delayed messages, also the delivery precision")
+	var dedupWindow = flag.Duration("dedup-window", 0, "dedup window of RPUSHID message ids by time, 0 is unlimited by time")
+	var dedupCount = flag.Int("dedup-count", 0, "dedup window of RPUSHID message ids by count, 0 is unlimited by count, both 0 disables dedup")
+	var compress = flag.String("compress", "none", "compression of written records: none|flate|gzip")
+	var compressMin = flag.Int("compress-min", db.DEFAULT_COMPRESS_MIN, "records smaller than this are not compressed")
+	var keyFile = flag.String("key-file", "", "file of AES-GCM keys id:hex per line to encrypt records, the last key encrypts, default is the DQUEUE_KEYS environment")
+	var lanes = flag.Int("lanes", 1, "default number of priority lanes of each queue, LANES overrides it per queue")
+	var lanePolicy = flag.String("lane-policy", "strict", "how to pop from priority lanes: strict|weighted")
+	var laneWeights = flag.String("lane-weights", "", "comma separated weights of lanes for the weighted policy, default is priority+1")
 	flag.Parse()
 
+	conf := fs.DefaultConfig()
+	switch *retire {
+	case "delete":
+		conf.Retire = fs.RETIRE_DELETE
+	case "archive":
+		conf.Retire = fs.RETIRE_ARCHIVE
+	case "gzip":
+		conf.Retire = fs.RETIRE_COMPRESS
+	case "keep":
+		conf.Retire = fs.RETIRE_KEEP
+	default:
+		fmt.Println("unknown retire mode", *retire)
+		os.Exit(1)
+	}
+	if conf.Retire == fs.RETIRE_ARCHIVE && *archive == "" {
+		fmt.Println("archive dir is required")
+		os.Exit(1)
+	}
+	conf.ArchiveDir = *archive
+	if *seekWindow < 0 {
+		fmt.Println("seek window must not be negative")
+		os.Exit(1)
+	}
+	conf.SeekWindow = *seekWindow
+	switch *appendfsync {
+	case "always":
+		conf.Sync = fs.SYNC_ALWAYS
+	case "everysec":
+		conf.Sync = fs.SYNC_EVERYSEC
+	case "no":
+		conf.Sync = fs.SYNC_NO
+	default:
+		fmt.Println("unknown appendfsync policy", *appendfsync)
+		os.Exit(1)
+	}
+	if *segmentSize <= 0 || *segmentSize > db.MAX_SEGMENT_SIZE {
+		fmt.Println("segment size must be between 1 and", db.MAX_SEGMENT_SIZE)
+		os.Exit(1)
+	}
+	conf.SegmentSize = *segmentSize
+	conf.MaxBytes = *maxBytes
+	conf.MaxRecords = *maxRecords
+	conf.MaxAge = *maxAge
+	conf.DelayBucket = *delayBucket
+	conf.DedupWindow = *dedupWindow
+	conf.DedupCount = *dedupCount
+	codec, err := db.ParseCodec(*compress)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	conf.Compression = codec
+	conf.CompressMin = *compressMin
+	conf.KeyFile = *keyFile
+	if *lanes < 1 || *lanes > fs.MAX_LANES {
+		fmt.Println("lanes must be between 1 and", fs.MAX_LANES)
+		os.Exit(1)
+	}
+	conf.Lanes = *lanes
+	policy, err := fs.ParseLanePolicy(*lanePolicy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	conf.LanePolicy = policy
+	if *laneWeights != "" {
+		for _, w := range strings.Split(*laneWeights, ",") {
+			weight, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil || weight <= 0 {
+				fmt.Println("invalid lane weight", w)
+				os.Exit(1)
+			}
+			conf.LaneWeights = append(conf.LaneWeights, weight)
+		}
+	}
+	switch *retention {
+	case "reject":
+		conf.Retention = fs.RETENTION_REJECT
+	case "drop":
+		conf.Retention = fs.RETENTION_DROP
+	default:
+		fmt.Println("unknown retention policy", *retention)
+		os.Exit(1)
+	}
+
 	// 启动redis server
-	handler = &DQueueHandler{
-		queues: make(map[string]*fs.DQueueFs, 1),
-		sub:    make(map[string][]*redis.ChannelWriter, 1),
+	if *database < 0 || *database >= *databases {
+		fmt.Println("db must be between 0 and", *databases-1)
+		os.Exit(1)
+	}
+	// 队列目录在数据库目录下,启动时不打开,第一次使用时才打开,其他数据库第一次SELECT的时候才扫描
+	state := &shared{
+		root:      *dir,
+		conf:      conf,
+		idle:      *idleClose,
+		databases: *databases,
+		rpopFifo:  *rpopFifo,
+	}
+	handler, err = state.connect(*database)
+	if err != nil {
+		fmt.Println("init queue manager failed")
+		os.Exit(1)
+	}
+	// 启动之前检查所有命令,连接建立以后才创建每个连接的server
+	if _, err := redis.NewServer(redis.DefaultConfig().Proto("tcp").Host(host).Port(port).Handler(handler)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// 自己创建listener,关闭的时候停止接受新的连接
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	server, _ := redis.NewServer(redis.DefaultConfig().Proto("tcp").Host(host).Port(port).Handler(handler))
 
 	// 处理信号量
-	go sigHandler()
+	go sigHandler(l)
 
 	// 服务状态信息
 	router := httprouter.New()
@@ -155,33 +1220,46 @@ func ListenAndServeRedis() {
 
 	go http.ListenAndServe(":8081", nil)
 
-	server.ListenAndServe()
+	err = serve(l, host, port)
+	log.Println("stop serving", err)
+	// 等待正在执行的命令,关闭所有队列
+	handler.shutdown()
+	Destory()
+}
+
+// 每个连接一个handler,连接上SELECT选择的数据库互不影响
+func serve(l net.Listener, host string, port int) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		h := *handler
+		server, err := redis.NewServer(redis.DefaultConfig().Proto("tcp").Host(host).Port(port).Handler(&h))
+		if err != nil {
+			log.Println(err)
+			conn.Close()
+			continue
+		}
+		go server.ServeClient(conn)
+	}
 }
 
 func Destory() {
 	pprof.StopCPUProfile()
 }
 
-func sigHandler() {
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, os.Interrupt)
-	for {
-		select {
-		case sig := <-ch:
-			Destory()
-			fmt.Println(sig)
-			os.Exit(0)
-			break
-		}
-	}
+// 收到信号以后关闭listener,ListenAndServeRedis退出之前完成清理
+func sigHandler(l net.Listener) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, os.Interrupt)
+	sig := <-ch
+	fmt.Println(sig)
+	l.Close()
 }
 
 func Status(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	status := make(map[string]interface{})
-	for queueName, queue := range handler.queues {
-		status[queueName] = queue.Stats()
-	}
-	b, _ := json.Marshal(status)
+	b, _ := json.Marshal(handler.manager.Stats())
 
 	w.Write(b)
 }
@@ -1,9 +1,60 @@
 package proxy
 
 import (
+	"github.com/wudikua/dqueue/manager"
+	"os"
 	"testing"
 )
 
 func Test_Serve(t *testing.T) {
 	ListenAndServeRedis()
 }
+
+// 每个连接选择自己的数据库,队列在各自数据库的目录下
+func Test_Select(t *testing.T) {
+	os.RemoveAll("test_select")
+	defer os.RemoveAll("test_select")
+	state := &shared{root: "test_select", databases: 4}
+	h, err := state.connect(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := state.connect(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.shutdown()
+	if n, err := h.RPUSH("q", []byte("a")); err != nil || n != 1 {
+		t.Fail()
+	}
+	if bs, err := h.SELECT("1"); err != nil || string(bs) != "OK" {
+		t.Fail()
+	}
+	if n, err := h.LLEN("q"); err != nil || n != 0 {
+		t.Fail()
+	}
+	if n, err := h.RPUSH("q", []byte("b"), []byte("c")); err != nil || n != 2 {
+		t.Fail()
+	}
+	if _, err := os.Stat(manager.DatabaseDir("test_select", 1) + "/q"); err != nil {
+		t.Fail()
+	}
+	// 其他连接还在0号数据库
+	if n, err := other.LLEN("q"); err != nil || n != 1 {
+		t.Fail()
+	}
+	if _, err := h.SELECT("0"); err != nil {
+		t.Fail()
+	}
+	if n, err := h.LLEN("q"); err != nil || n != 1 {
+		t.Fail()
+	}
+	for _, index := range []string{"x", "-1", "4"} {
+		if _, err := h.SELECT(index); err == nil {
+			t.Fail()
+		}
+	}
+	if h.db != 0 {
+		t.Fail()
+	}
+}
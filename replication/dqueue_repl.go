@@ -8,8 +8,12 @@ import (
 	"github.com/wudikua/dqueue/fs"
 	"github.com/wudikua/dqueue/global"
 	"github.com/wudikua/dqueue/idx"
+	"github.com/wudikua/dqueue/manager"
 	"github.com/xuyu/goredis"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 )
 
 // 同步从节点
@@ -17,10 +21,13 @@ type DQueueReplication struct {
 	replicationChannel chan []byte
 	master             *goredis.Redis
 	queues             map[string]*fs.DQueueFs
+	// 从库的数据库目录,和主库一样是manager.DatabaseDir(dir, db)
+	root string
 }
 
-func NewDQueueReplication(addr string) (*DQueueReplication, error) {
-	master, err := goredis.Dial(&goredis.DialConfig{Address: addr})
+// database是同步的主库逻辑数据库,root是从库保存队列的数据库目录
+func NewDQueueReplication(addr string, database int, root string) (*DQueueReplication, error) {
+	master, err := goredis.Dial(&goredis.DialConfig{Address: addr, Database: database})
 	if err != nil {
 		return nil, err
 	}
@@ -28,6 +35,7 @@ func NewDQueueReplication(addr string) (*DQueueReplication, error) {
 		replicationChannel: make(chan []byte, 1024),
 		master:             master,
 		queues:             make(map[string]*fs.DQueueFs),
+		root:               root,
 	}, nil
 }
 
@@ -47,11 +55,26 @@ func (this *DQueueReplication) Greet() ([]string, error) {
 	return queues, err
 }
 
+// 一个通道正在同步的数据文件和索引,0号通道是队列目录,其他通道在lane_N
+type laneSync struct {
+	path  string
+	dbs   *db.DQueueDB
+	index *idx.DQueueIndex
+}
+
 // 订阅一个队列数据的变更
 func (this *DQueueReplication) SyncDQueue(queue string) error {
 	quit := make(chan bool)
-	var dbs *db.DQueueDB
-	var index *idx.DQueueIndex
+	// 和主库一样把队列名编码成数据库目录下的目录
+	path, err := manager.EncodeKey(queue)
+	if err != nil {
+		return err
+	}
+	path = filepath.Join(this.root, path)
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return err
+	}
+	lanes := map[int]*laneSync{0: {path: path}}
 	// 初始化数据
 	sub, err := this.master.PubSub()
 	defer sub.Close()
@@ -67,69 +90,96 @@ func (this *DQueueReplication) SyncDQueue(queue string) error {
 		}
 		if list[0] == "message" {
 			arr := []byte(list[2])
+			st := lanes[0]
+			if arr[0] == global.OP_LANE {
+				// 其他通道的变更,去掉通道编号以后和队列的变更一样处理
+				lane := int(binary.BigEndian.Uint32(arr[1:]))
+				if st = lanes[lane]; st == nil {
+					st = &laneSync{path: fmt.Sprintf("%s/lane_%d", path, lane)}
+					if err := os.MkdirAll(st.path, 0777); err != nil {
+						log.Println(err)
+						continue
+					}
+					lanes[lane] = st
+				}
+				arr = arr[5:]
+			}
 			switch arr[0] {
 			case global.OP_NEW:
 				// 创建新的DB
-				dbNo := int(binary.BigEndian.Uint32(arr[1:]))
-				dbs = db.NewInstance(fmt.Sprintf("%s/dqueue_%d.db", list[1], dbNo), dbNo)
+				dbNo := field(arr, 0, 1)
+				st.dbs = db.NewInstance(fmt.Sprintf("%s/dqueue_%d.db", st.path, dbNo), dbNo)
+				// 主库从头同步整个数据文件
+				st.dbs.SetWritePos(0)
 			case global.OP_DB_APPEND:
-				// 向已经创建的DB顺序写
-				stream := dbs.GetWriteStream()
-				_, err := stream.Write(arr)
+				// 向已经创建的DB顺序写,去掉操作数,记录头和数据原样写入
+				stream := st.dbs.GetWriteStream()
+				_, err := stream.Write(arr[1:])
 				if err != nil {
 					log.Println(err)
 				}
 				stream.Flush()
 			case global.OP_IDX_READ_WRITE_LEN:
-				readIndex := int(binary.BigEndian.Uint32(arr[1:]))
-				writeIndex := int(binary.BigEndian.Uint32(arr[5:]))
-				length := int(binary.BigEndian.Uint32(arr[9:]))
-				if index == nil {
+				readIndex := field(arr, 0, 3)
+				writeIndex := field(arr, 1, 3)
+				length := field(arr, 2, 3)
+				if st.index == nil {
 					// 创建索引文件
-					index = idx.NewInstance(list[1] + "/dqueue.idx")
+					st.index = idx.NewInstance(st.path + "/dqueue.idx")
 				}
-				index.SetReadIndex(readIndex)
-				index.SetWriteIndex(writeIndex)
-				index.SetLength(length)
+				st.index.Begin()
+				st.index.SetReadIndex(readIndex)
+				st.index.SetWriteIndex(writeIndex)
+				st.index.SetLength(length)
+				st.index.Commit()
 			case global.OP_IDX_READ:
 				// 主库同步读队列的进度
-				readIndex := int(binary.BigEndian.Uint32(arr[1:5]))
-				length := int(binary.BigEndian.Uint32(arr[5:9]))
+				readIndex := field(arr, 0, 2)
+				length := field(arr, 1, 2)
 				// 主库同步写队列的进度
-				if index == nil {
+				if st.index == nil {
 					// 创建索引文件
-					index = idx.NewInstance(list[1] + "/dqueue.idx")
+					st.index = idx.NewInstance(st.path + "/dqueue.idx")
 				}
-				index.SetWriteIndex(readIndex)
-				index.SetLength(length)
+				st.index.Begin()
+				st.index.SetWriteIndex(readIndex)
+				st.index.SetLength(length)
+				st.index.Commit()
 			case global.OP_IDX_WRITE:
-				writeIndex := int(binary.BigEndian.Uint32(arr[1:5]))
-				length := int(binary.BigEndian.Uint32(arr[5:9]))
+				writeIndex := field(arr, 0, 2)
+				length := field(arr, 1, 2)
 				// 主库同步写队列的进度
-				if index == nil {
+				if st.index == nil {
 					// 创建索引文件
-					index = idx.NewInstance(list[1] + "/dqueue.idx")
+					st.index = idx.NewInstance(st.path + "/dqueue.idx")
 				}
-				index.SetWriteIndex(writeIndex)
-				index.SetLength(length)
+				st.index.Begin()
+				st.index.SetWriteIndex(writeIndex)
+				st.index.SetLength(length)
+				st.index.Commit()
 			case global.OP_CHANGE_READNO:
 				// 主库读换页
-				dbNo := int(binary.BigEndian.Uint32(arr[1:]))
-				if index == nil {
+				dbNo := field(arr, 0, 1)
+				if st.index == nil {
 					// 创建索引文件
-					index = idx.NewInstance(list[1] + "/dqueue.idx")
+					st.index = idx.NewInstance(st.path + "/dqueue.idx")
 				}
-				index.SetReadNo(dbNo)
+				st.index.SetReadNo(dbNo)
 				// log.Println("change read", dbNo)
 			case global.OP_CHANGE_WRITENO:
 				// 主库写换页
-				dbNo := int(binary.BigEndian.Uint32(arr[1:]))
-				if index == nil {
+				dbNo := field(arr, 0, 1)
+				if st.index == nil {
 					// 创建索引文件
-					index = idx.NewInstance(list[1] + "/dqueue.idx")
+					st.index = idx.NewInstance(st.path + "/dqueue.idx")
 				}
-				index.SetWriteNo(dbNo)
+				st.index.SetWriteNo(dbNo)
 				// log.Println("change write", dbNo)
+			case global.OP_DEDUP:
+				// 主库的去重快照,从库打开队列的时候从快照和之后的数据重建去重索引
+				if err := ioutil.WriteFile(st.path+"/dqueue.dedup", arr[1:], 0660); err != nil {
+					log.Println(err)
+				}
 			case global.OP_HEARTBEAT:
 				// 主库发过来的心跳代表自己还活着
 			default:
@@ -152,3 +202,12 @@ func (this *DQueueReplication) Sync() {
 		}
 	}
 }
+
+// 读取变更消息操作数之后的第i个字段,消息一共有n个字段
+// 主库发送64位的编号和位置,升级之前的主库发送32位
+func field(arr []byte, i int, n int) int {
+	if len(arr) >= 1+8*n {
+		return int(binary.BigEndian.Uint64(arr[1+8*i:]))
+	}
+	return int(binary.BigEndian.Uint32(arr[1+4*i:]))
+}
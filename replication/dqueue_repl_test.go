@@ -5,14 +5,14 @@ import (
 )
 
 // func Test_NewDQueueReplication(t *testing.T) {
-// 	instance, err := NewDQueueReplication(":9008")
+// 	instance, err := NewDQueueReplication(":9008", 0, ".")
 // 	if err != nil || instance == nil {
 // 		t.Fail()
 // 	}
 // }
 
 // func Test_Greet(t *testing.T) {
-// 	instance, err := NewDQueueReplication(":9008")
+// 	instance, err := NewDQueueReplication(":9008", 0, ".")
 // 	if err != nil {
 // 		t.Fail()
 // 	}
@@ -24,7 +24,7 @@ import (
 // }
 
 func Test_SyncDQueue(t *testing.T) {
-	instance, err := NewDQueueReplication(":9008")
+	instance, err := NewDQueueReplication(":9008", 0, ".")
 	if err != nil {
 		t.Fail()
 	}
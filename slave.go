@@ -1,10 +1,21 @@
 package main
 
 import (
+	"flag"
+	"github.com/wudikua/dqueue/manager"
 	"github.com/wudikua/dqueue/replication"
+	"log"
 )
 
 func main() {
-	instance, _ := replication.NewDQueueReplication(":9008")
-	instance.SyncDQueue("redis-buffering")
+	var master = flag.String("master", ":9008", "address of the master")
+	var dir = flag.String("dir", ".", "data root dir of all queues")
+	var database = flag.Int("db", 0, "logical database to replicate, db N is stored in dir/db@N")
+	var queue = flag.String("queue", "redis-buffering", "queue to replicate")
+	flag.Parse()
+	instance, err := replication.NewDQueueReplication(*master, *database, manager.DatabaseDir(*dir, *database))
+	if err != nil {
+		log.Fatal(err)
+	}
+	instance.SyncDQueue(*queue)
 }